@@ -0,0 +1,343 @@
+package picfit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	imagepkg "image"
+	"io"
+	"time"
+
+	"github.com/mholt/binding"
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/engine"
+	"github.com/thoas/picfit/failure"
+	"github.com/thoas/picfit/image"
+)
+
+// megapixel is the number of pixels charged per slot of the semaphore.
+const megapixel = 1000 * 1000
+
+// maxWeightShare is the inverse of the largest share of the semaphore
+// slots taken by a single source.
+const maxWeightShare = 4
+
+// backgroundPollInterval is the interval at which background requests try
+// to get slots of the semaphore.
+const backgroundPollInterval = 10 * time.Millisecond
+
+// sourceInfo describes a source image from its headers.
+type sourceInfo struct {
+	size   int
+	width  int
+	height int
+	frames int
+}
+
+// pixels returns the number of pixels decoded for all frames.
+func (s sourceInfo) pixels() int64 {
+	return int64(s.width) * int64(s.height) * int64(s.frames)
+}
+
+// inspectSource reads the source, up to the maximum input bytes, and
+// returns its description without decoding it, the stream is buffered
+// to be read again.
+func (p *Processor) inspectSource(file *image.ImageFile) (*sourceInfo, error) {
+	var (
+		reader   io.Reader = file.Stream
+		maxBytes           = p.config.Options.MaxInputBytes
+	)
+
+	if maxBytes > 0 {
+		reader = io.LimitReader(reader, int64(maxBytes)+1)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	file.Stream.Close()
+	file.Stream = io.NopCloser(bytes.NewReader(data))
+
+	if maxBytes > 0 && len(data) > maxBytes {
+		return nil, binding.Errors{binding.NewError([]string{"size"}, failure.ErrFileMaxDimensions.Error(), fmt.Sprintf("max size is %d bytes", maxBytes))}
+	}
+
+	cfg, format, err := imagepkg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, &failure.SourceError{Type: failure.SourceUndecodable, Err: errors.WithStack(err)}
+	}
+
+	info := &sourceInfo{
+		size:   len(data),
+		width:  cfg.Width,
+		height: cfg.Height,
+		frames: 1,
+	}
+
+	if format == "gif" {
+		if info.frames, err = gifFrames(data); err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// checkImageLimits rejects sources exceeding the maximum dimensions,
+// pixels or, for animated images, pixels of all frames.
+func (p *Processor) checkImageLimits(info *sourceInfo) error {
+	if max := p.maxImageDimensions; max != nil {
+		if (max.Width > 0 && info.width > max.Width) || (max.Height > 0 && info.height > max.Height) {
+			return binding.Errors{binding.NewError([]string{"dimensions"}, failure.ErrFileMaxDimensions.Error(), fmt.Sprintf("max dimensions is %d x %d", max.Width, max.Height))}
+		}
+	}
+
+	if max := p.config.Options.MaxImagePixels; max > 0 && int64(info.width)*int64(info.height) > int64(max) {
+		return binding.Errors{binding.NewError([]string{"pixels"}, failure.ErrFileMaxDimensions.Error(), fmt.Sprintf("max pixels is %d", max))}
+	}
+
+	if max := p.config.Options.MaxAnimationPixels; max > 0 && info.frames > 1 && info.pixels() > int64(max) {
+		return binding.Errors{binding.NewError([]string{"frames"}, failure.ErrFileMaxDimensions.Error(), fmt.Sprintf("max pixels of all frames is %d", max))}
+	}
+
+	return nil
+}
+
+// checkSources checks the sources against the limits from their headers
+// before they are decoded.
+func (p *Processor) checkSources(files ...*image.ImageFile) ([]*sourceInfo, error) {
+	infos := make([]*sourceInfo, len(files))
+	for i := range files {
+		info, err := p.inspectSource(files[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.checkImageLimits(info); err != nil {
+			return nil, err
+		}
+		infos[i] = info
+	}
+
+	return infos, nil
+}
+
+// borderedSource returns the description of the source extended by the
+// borders and shadows of the operations, nil when none extends it.
+func borderedSource(info *sourceInfo, operations []engine.EngineOperation) *sourceInfo {
+	bordered := *info
+	for i := range operations {
+		if operations[i].Operation != engine.Border {
+			continue
+		}
+
+		options := operations[i].Options
+		if options.Border != nil {
+			bordered.width += options.Border.Left + options.Border.Right
+			bordered.height += options.Border.Top + options.Border.Bottom
+		}
+		bordered.width += options.Shadow
+		bordered.height += options.Shadow
+	}
+
+	if bordered == *info {
+		return nil
+	}
+
+	return &bordered
+}
+
+// admitSources checks the sources against the limits from their headers,
+// then waits for their slots in the semaphore before they are decoded, it
+// returns the function releasing the slots.
+func (p *Processor) admitSources(ctx context.Context, files ...*image.ImageFile) (func(), error) {
+	infos, err := p.checkSources(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.withSemaphore {
+		return func() {}, nil
+	}
+
+	return p.acquireSemaphore(ctx, p.semaphoreWeight(infos...), PriorityInteractive)
+}
+
+// semaphoreWeight returns the number of slots taken by the sources, one per
+// started megapixel of all frames. The semaphore serves waiters in order,
+// sources never take more than a share of the slots so a huge image does not
+// wait for all of them to be freed while smaller ones queue behind it.
+func (p *Processor) semaphoreWeight(infos ...*sourceInfo) int64 {
+	var pixels int64
+	for _, info := range infos {
+		if info != nil {
+			pixels += info.pixels()
+		}
+	}
+
+	weight := (pixels + megapixel - 1) / megapixel
+
+	return min(max(weight, 1), max(p.semaphoreSize/maxWeightShare, 1))
+}
+
+// gifFrames counts the frames of a GIF by walking its blocks, image data
+// is skipped without being decompressed.
+func gifFrames(data []byte) (int, error) {
+	errInvalid := errors.New("gif: unable to count frames of a truncated image")
+
+	// header and logical screen descriptor
+	pos := 13
+	if len(data) < pos {
+		return 0, errInvalid
+	}
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << ((flags & 0x07) + 1)
+	}
+
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			n := int(data[pos])
+			pos += n + 1
+			if n == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var frames int
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x2C: // image descriptor
+			if pos+10 > len(data) {
+				return 0, errInvalid
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1)
+			}
+			// LZW minimum code size
+			pos++
+			if !skipSubBlocks() {
+				return 0, errInvalid
+			}
+			frames++
+		case 0x21: // extension
+			pos += 2
+			if !skipSubBlocks() {
+				return 0, errInvalid
+			}
+		case 0x3B: // trailer
+			return max(frames, 1), nil
+		default:
+			return 0, errInvalid
+		}
+	}
+
+	return max(frames, 1), nil
+}
+
+// acquireSemaphore waits for slots in the semaphore and returns the function
+// releasing them, requests are shed when too many requests are waiting or
+// when they wait for too long.
+//
+// Background requests take at most their share of the slots and only get
+// slots when no interactive request is waiting.
+func (p *Processor) acquireSemaphore(ctx context.Context, weight int64, priority Priority) (func(), error) {
+	var (
+		lane     = priority.String()
+		maxQueue = int64(p.config.Options.MaxProcessorQueue)
+		maxWait  = time.Duration(p.config.Options.MaxProcessorWait) * time.Second
+		overload = &failure.OverloadedError{RetryAfter: max(maxWait, time.Second)}
+		start    = time.Now()
+	)
+
+	if priority == PriorityInteractive && p.semaphore.TryAcquire(weight) {
+		defaultMetrics.semaphoreWait.WithLabelValues(lane).Observe(0)
+		return func() { p.semaphore.Release(weight) }, nil
+	}
+
+	waiting := p.semaphoreWaiting.Add(1)
+	defer p.semaphoreWaiting.Add(-1)
+	if priority == PriorityInteractive {
+		p.interactiveWaiting.Add(1)
+		defer p.interactiveWaiting.Add(-1)
+	}
+
+	queue := defaultMetrics.semaphoreQueue.WithLabelValues(lane)
+	queue.Inc()
+	defer queue.Dec()
+
+	if maxQueue > 0 && waiting > maxQueue {
+		defaultMetrics.semaphoreShed.WithLabelValues("queue", lane).Inc()
+		return nil, overload
+	}
+
+	waitctx := ctx
+	if maxWait > 0 {
+		var cancel context.CancelFunc
+		waitctx, cancel = context.WithTimeout(ctx, maxWait)
+		defer cancel()
+	}
+
+	var (
+		release func()
+		err     error
+	)
+	if priority == PriorityInteractive {
+		if err = p.semaphore.Acquire(waitctx, weight); err == nil {
+			release = func() { p.semaphore.Release(weight) }
+		}
+	} else {
+		release, err = p.acquireBackground(waitctx, weight)
+	}
+
+	defaultMetrics.semaphoreWait.WithLabelValues(lane).Observe(time.Since(start).Seconds())
+	if err != nil {
+		if ctx.Err() == nil {
+			defaultMetrics.semaphoreShed.WithLabelValues("wait", lane).Inc()
+			return nil, overload
+		}
+
+		return nil, errors.WithStack(ctx.Err())
+	}
+
+	return release, nil
+}
+
+// acquireBackground waits for slots of the background share, then for slots
+// of the semaphore left by interactive requests.
+func (p *Processor) acquireBackground(ctx context.Context, weight int64) (func(), error) {
+	release := func() {}
+	if p.backgroundSemaphore != nil {
+		share := min(weight, p.backgroundSize)
+		if err := p.backgroundSemaphore.Acquire(ctx, share); err != nil {
+			return nil, err
+		}
+		release = func() { p.backgroundSemaphore.Release(share) }
+	}
+
+	// background requests do not queue in the semaphore to not be waited
+	// for by interactive requests
+	ticker := time.NewTicker(backgroundPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if p.interactiveWaiting.Load() == 0 && p.semaphore.TryAcquire(weight) {
+			return func() {
+				p.semaphore.Release(weight)
+				release()
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
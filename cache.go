@@ -0,0 +1,153 @@
+package picfit
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/thoas/picfit/image"
+	"github.com/thoas/picfit/storage"
+)
+
+// renderCache is a least recently used cache of rendered images bounded by
+// the size of the images.
+type renderCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	maxSize int64
+	ttl     time.Duration
+}
+
+// renderEntry is a rendered image in the cache.
+type renderEntry struct {
+	key      string
+	filepath string
+	headers  map[string]string
+	data     []byte
+	expires  time.Time
+}
+
+// newRenderCache returns a cache of maxSize bytes, nil when maxSize is not
+// positive, entries expire after ttl unless ttl is zero.
+func newRenderCache(maxSize int64, ttl time.Duration) *renderCache {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	return &renderCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		maxSize: maxSize,
+		ttl:     ttl,
+	}
+}
+
+// get returns the image rendered with the key, or nil.
+func (c *renderCache) get(key string, s *storage.Storage) *image.ImageFile {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok && c.expired(elem.Value.(*renderEntry)) {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		defaultMetrics.renderCache.WithLabelValues("miss").Inc()
+		return nil
+	}
+
+	defaultMetrics.renderCache.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(elem)
+
+	entry := elem.Value.(*renderEntry)
+
+	return &image.ImageFile{
+		Key:        entry.key,
+		Filepath:   entry.filepath,
+		Headers:    maps.Clone(entry.headers),
+		Storage:    s,
+		Stream:     io.NopCloser(bytes.NewReader(entry.data)),
+		HTTPStream: bytes.NewReader(entry.data),
+	}
+}
+
+// set reads the rendered image to cache it, the image is read again from
+// the cached data.
+func (c *renderCache) set(file *image.ImageFile) error {
+	if c == nil || file.HTTPStream == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(file.HTTPStream)
+	if err != nil {
+		return err
+	}
+	file.HTTPStream = bytes.NewReader(data)
+
+	// an image taking a large part of the cache would evict all others
+	if int64(len(data)) > c.maxSize/8 {
+		return nil
+	}
+
+	entry := &renderEntry{
+		key:      file.Key,
+		filepath: file.Filepath,
+		headers:  maps.Clone(file.Headers),
+		data:     data,
+	}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.data))
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+	defaultMetrics.renderCacheSize.Set(float64(c.size))
+
+	return nil
+}
+
+// delete removes the image rendered with the key.
+func (c *renderCache) delete(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *renderCache) expired(entry *renderEntry) bool {
+	return !entry.expires.IsZero() && time.Now().After(entry.expires)
+}
+
+func (c *renderCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*renderEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+	defaultMetrics.renderCacheSize.Set(float64(c.size))
+}
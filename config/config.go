@@ -33,6 +33,10 @@ type Options struct {
 	AllowedSizes                     []AllowedSize      `mapstructure:"allowed_sizes"`
 	DefaultUserAgent                 string             `mapstructure:"default_user_agent"`
 	EnableCascadeDelete              bool               `mapstructure:"enable_cascade_delete"`
+	EnableClientHints                bool               `mapstructure:"enable_client_hints"`
+	EnableCompare                    bool               `mapstructure:"enable_compare"`
+	EnableInfo                       bool               `mapstructure:"enable_info"`
+	EnableFocalPoint                 bool               `mapstructure:"enable_focal_point"`
 	EnableDelete                     bool               `mapstructure:"enable_delete"`
 	EnableHealth                     bool               `mapstructure:"enable_health"`
 	EnablePprof                      bool               `mapstructure:"enable_pprof"`
@@ -44,7 +48,23 @@ type Options struct {
 	TransformTimeout                 int                `mapstructure:"transform_timeout"`
 	MaxProcessorConcurrent           *int               `mapstructure:"max_processor_concurrent"`
 	MaxProcessorConcurrentOperations []engine.Operation `mapstructure:"max_processor_concurrent_operations"`
+	MaxProcessorBackgroundConcurrent int                `mapstructure:"max_processor_background_concurrent"`
+	MaxProcessorQueue                int                `mapstructure:"max_processor_queue"`
+	MaxProcessorWait                 int                `mapstructure:"max_processor_wait"`
 	MaxImageDimensions               *AllowedSize       `mapstructure:"max_image_dimensions"`
+	MaxImagePixels                   int                `mapstructure:"max_image_pixels"`
+	MaxAnimationPixels               int                `mapstructure:"max_animation_pixels"`
+	MaxInputBytes                    int                `mapstructure:"max_input_bytes"`
+	LockTimeout                      int                `mapstructure:"lock_timeout"`
+	RenderCacheSize                  int64              `mapstructure:"render_cache_size"`
+	RenderCacheTTL                   int                `mapstructure:"render_cache_ttl"`
+	SourceCheckInterval              int                `mapstructure:"source_check_interval"`
+	SourceFailureTTL                 int                `mapstructure:"source_failure_ttl"`
+	StoreWorkers                     int                `mapstructure:"store_workers"`
+	StoreQueueSize                   int                `mapstructure:"store_queue_size"`
+	StoreRetries                     int                `mapstructure:"store_retries"`
+	StoreTimeout                     int                `mapstructure:"store_timeout"`
+	StoreDrainTimeout                int                `mapstructure:"store_drain_timeout"`
 }
 
 // Sentry is a struct to configure sentry using a dsn
@@ -84,10 +104,16 @@ func DefaultConfig() *Config {
 			WebpQuality:     DefaultQuality,
 		},
 		Options: &Options{
-			DefaultUserAgent: fmt.Sprint(DefaultUserAgent, "/", constants.Version),
-			EnableDelete:     false,
-			EnableUpload:     false,
-			MimetypeDetector: DefaultMimetypeDetector,
+			DefaultUserAgent:  fmt.Sprint(DefaultUserAgent, "/", constants.Version),
+			EnableDelete:      false,
+			EnableUpload:      false,
+			MimetypeDetector:  DefaultMimetypeDetector,
+			TransformTimeout:  DefaultTransformTimeout,
+			StoreWorkers:      DefaultStoreWorkers,
+			StoreQueueSize:    DefaultStoreQueueSize,
+			StoreRetries:      DefaultStoreRetries,
+			StoreTimeout:      DefaultStoreTimeout,
+			StoreDrainTimeout: DefaultStoreDrainTimeout,
 		},
 		Port: DefaultPort,
 		KVStore: &store.Config{
@@ -140,7 +166,28 @@ func load(content string, isPath bool) (*Config, error) {
 	}
 
 	if config.Options.TransformTimeout == 0 {
-		config.Options.TransformTimeout = 10
+		config.Options.TransformTimeout = DefaultTransformTimeout
+	}
+
+	if config.Options.StoreWorkers == 0 {
+		config.Options.StoreWorkers = DefaultStoreWorkers
+	}
+
+	if config.Options.StoreQueueSize == 0 {
+		config.Options.StoreQueueSize = DefaultStoreQueueSize
+	}
+
+	// a negative number of retries disables them
+	if config.Options.StoreRetries == 0 {
+		config.Options.StoreRetries = DefaultStoreRetries
+	}
+
+	if config.Options.StoreTimeout == 0 {
+		config.Options.StoreTimeout = DefaultStoreTimeout
+	}
+
+	if config.Options.StoreDrainTimeout == 0 {
+		config.Options.StoreDrainTimeout = DefaultStoreDrainTimeout
 	}
 
 	return config, nil
@@ -25,4 +25,22 @@ const (
 
 	// DefaultShardRestOnly is the default shard rest behaviour
 	DefaultShardRestOnly = true
+
+	// DefaultTransformTimeout is the default timeout in seconds of transformations
+	DefaultTransformTimeout = 10
+
+	// DefaultStoreWorkers is the default number of workers storing images in the background
+	DefaultStoreWorkers = 4
+
+	// DefaultStoreQueueSize is the default number of images waiting to be stored in the background
+	DefaultStoreQueueSize = 100
+
+	// DefaultStoreRetries is the default number of retries of a failed background storage
+	DefaultStoreRetries = 3
+
+	// DefaultStoreTimeout is the default timeout in seconds of a background storage
+	DefaultStoreTimeout = 60
+
+	// DefaultStoreDrainTimeout is the default time in seconds given to store the queued images on shutdown
+	DefaultStoreDrainTimeout = 30
 )
@@ -40,10 +40,101 @@ var StickPositions = []string{
 	TopRight,
 }
 
-const FilterBlur = "blur"
+const (
+	FilterBlur      = "blur"
+	FilterBlurFaces = "blur-faces"
+	FilterEnhance   = "enhance"
+	FilterDuotone   = "duotone"
+	FilterTint      = "tint"
+	FilterOverlay   = "overlay"
+)
 
 var Filters = []string{
 	FilterBlur,
+	FilterBlurFaces,
+	FilterEnhance,
+	FilterDuotone,
+	FilterTint,
+	FilterOverlay,
+}
+
+// ColorFilters are the filters requiring a color.
+var ColorFilters = []string{
+	FilterDuotone,
+	FilterTint,
+	FilterOverlay,
+}
+
+const (
+	EnhanceLevels       = "levels"
+	EnhanceEqualize     = "equalize"
+	EnhanceWhiteBalance = "whitebalance"
+)
+
+var EnhanceModes = []string{
+	EnhanceLevels,
+	EnhanceEqualize,
+	EnhanceWhiteBalance,
+}
+
+const (
+	GravityCenter = "center"
+	GravityFace   = "face"
+)
+
+var Gravities = []string{
+	GravityCenter,
+	GravityFace,
+}
+
+const (
+	BarcodeQR      = "qr"
+	BarcodeCode128 = "code128"
+)
+
+var BarcodeModes = []string{
+	BarcodeQR,
+	BarcodeCode128,
+}
+
+const (
+	CollageFill = "fill"
+	CollageFit  = "fit"
+)
+
+var CollageModes = []string{
+	CollageFill,
+	CollageFit,
+}
+
+const (
+	RedactPixelate = "pixelate"
+	RedactBlur     = "blur"
+	RedactFill     = "fill"
+)
+
+var RedactModes = []string{
+	RedactPixelate,
+	RedactBlur,
+	RedactFill,
+}
+
+const (
+	ResampleNearest    = "nearest"
+	ResampleBox        = "box"
+	ResampleLinear     = "linear"
+	ResampleCatmullRom = "catmull-rom"
+	ResampleMitchell   = "mitchell"
+	ResampleLanczos    = "lanczos"
+)
+
+var ResampleFilters = []string{
+	ResampleNearest,
+	ResampleBox,
+	ResampleLinear,
+	ResampleCatmullRom,
+	ResampleMitchell,
+	ResampleLanczos,
 }
 
 const ModifiedTimeFormat = time.RFC1123
@@ -4,4 +4,6 @@ const (
 	ForceParamName     = "force"
 	SigParamName       = "sig"
 	OperationParamName = "op"
+	// HintsParamName is set on parameters resolved from client hints
+	HintsParamName = "hints"
 )
@@ -3,7 +3,10 @@ package backend
 import (
 	"context"
 	"fmt"
+	stdimage "image"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/thoas/picfit/image"
@@ -14,17 +17,154 @@ var MethodNotImplementedError = errors.New("Not implemented")
 
 // Options is the engine options
 type Options struct {
-	Color    string
-	Degree   int
-	Filter   string
-	Format   image.Format
-	Height   int
-	Images   []image.ImageFile
-	Position string
-	Quality  int
-	Stick    string
-	Upscale  bool
-	Width    int
+	Background string
+	Border     *Border
+	Color      string
+	Degree     int
+	Filter     string
+	FocalPoint *FocalPoint
+	Format     image.Format
+	Gravity    string
+	Height     int
+	Gutter     int
+	Images     []image.ImageFile
+	Layout     []int
+	MaxBytes   int
+	Mode       string
+	Position   string
+	Quality    int
+	Resample   string
+	Shadow     int
+	Stick      string
+	Strength   int
+	Text       string
+	Upscale    bool
+	Width      int
+}
+
+// FocalPoint is the point of an image to keep in frame when cropping,
+// given as fractions of the image dimensions.
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// ParseFocalPoint parses a focal point in the "x,y" format.
+func ParseFocalPoint(value string) (*FocalPoint, error) {
+	x, y, ok := strings.Cut(value, ",")
+	if !ok {
+		return nil, fmt.Errorf("focal point %q should be in the x,y format", value)
+	}
+
+	var (
+		fp  = &FocalPoint{}
+		err error
+	)
+
+	if fp.X, err = strconv.ParseFloat(x, 64); err != nil {
+		return nil, errors.Wrapf(err, "invalid focal point %q", value)
+	}
+	if fp.Y, err = strconv.ParseFloat(y, 64); err != nil {
+		return nil, errors.Wrapf(err, "invalid focal point %q", value)
+	}
+
+	if fp.X < 0 || fp.X > 1 || fp.Y < 0 || fp.Y > 1 {
+		return nil, fmt.Errorf("focal point %q should be between 0 and 1", value)
+	}
+
+	return fp, nil
+}
+
+func (f FocalPoint) String() string {
+	return strconv.FormatFloat(f.X, 'f', -1, 64) + "," + strconv.FormatFloat(f.Y, 'f', -1, 64)
+}
+
+// Border is the width in pixels of each side of a border.
+type Border struct {
+	Top    int
+	Right  int
+	Bottom int
+	Left   int
+}
+
+// ParseBorder parses the widths of a border in the "width" format
+// or the "top.right.bottom.left" format.
+func ParseBorder(value string) (*Border, error) {
+	values := strings.Split(value, ".")
+	if len(values) != 1 && len(values) != 4 {
+		return nil, fmt.Errorf("border %q should be in the width or top.right.bottom.left format", value)
+	}
+
+	widths := make([]int, len(values))
+	for i := range values {
+		width, err := strconv.Atoi(values[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid border %q", value)
+		}
+
+		if width < 0 {
+			return nil, fmt.Errorf("border %q should not be negative", value)
+		}
+
+		widths[i] = width
+	}
+
+	if len(widths) == 1 {
+		return &Border{Top: widths[0], Right: widths[0], Bottom: widths[0], Left: widths[0]}, nil
+	}
+
+	return &Border{Top: widths[0], Right: widths[1], Bottom: widths[2], Left: widths[3]}, nil
+}
+
+// ParsePosition parses a rectangle in the "x0.y0.x1.y1" format, each
+// coordinate being a percentage of the image dimensions.
+func ParsePosition(value string) (stdimage.Rectangle, error) {
+	values := strings.Split(value, ".")
+	if len(values) != 4 {
+		return stdimage.Rectangle{}, fmt.Errorf("position %q should be in the x0.y0.x1.y1 format", value)
+	}
+
+	var coordinates [4]int
+	for i := range values {
+		coordinate, err := strconv.Atoi(values[i])
+		if err != nil {
+			return stdimage.Rectangle{}, errors.Wrapf(err, "invalid position %q", value)
+		}
+
+		if coordinate < 0 || coordinate > 100 {
+			return stdimage.Rectangle{}, fmt.Errorf("position %q should be between 0 and 100", value)
+		}
+
+		coordinates[i] = coordinate
+	}
+
+	r := stdimage.Rect(coordinates[0], coordinates[1], coordinates[2], coordinates[3])
+	if r.Empty() {
+		return stdimage.Rectangle{}, fmt.Errorf("position %q should not be empty", value)
+	}
+
+	return r, nil
+}
+
+// ParseLayout parses the number of cells of each row of a collage
+// in the "row.row.row" format.
+func ParseLayout(value string) ([]int, error) {
+	values := strings.Split(value, ".")
+	layout := make([]int, len(values))
+	for i := range values {
+		cells, err := strconv.Atoi(values[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid layout %q", value)
+		}
+
+		if cells < 1 {
+			return nil, fmt.Errorf("layout %q should have at least one cell per row", value)
+		}
+
+		layout[i] = cells
+	}
+
+	return layout, nil
 }
 
 func (o Options) String() string {
@@ -34,10 +174,17 @@ func (o Options) String() string {
 
 // Engine is an interface to define an image engine
 type Backend interface {
+	Barcode(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
+	Border(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
+	Collage(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
+	Crop(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
 	Effect(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
 	Fit(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
 	Flat(ctx context.Context, dst io.Writer, background *image.ImageFile, options *Options) error
+	Flatten(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
 	Flip(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
+	Liquid(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
+	Redact(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
 	Resize(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
 	Rotate(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error
 	String() string
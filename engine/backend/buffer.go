@@ -0,0 +1,128 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/gif"
+	"io"
+)
+
+// Buffer is the output of an intermediate operation, images rendered to
+// it are kept decoded so the next operation does not decode them again.
+// They are only encoded when the buffer is read, by backends working
+// on bytes such as gifsicle.
+type Buffer struct {
+	bytes.Buffer
+	image   image.Image
+	gif     *gif.GIF
+	options Options
+}
+
+// Read implements io.Reader, the kept image is encoded on first read.
+func (b *Buffer) Read(p []byte) (int, error) {
+	if err := b.encode(); err != nil {
+		return 0, err
+	}
+
+	return b.Buffer.Read(p)
+}
+
+// WriteTo implements io.WriterTo, the kept image is encoded first.
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	if err := b.encode(); err != nil {
+		return 0, err
+	}
+
+	return b.Buffer.WriteTo(w)
+}
+
+// Close implements io.Closer.
+func (b *Buffer) Close() error {
+	return nil
+}
+
+func (b *Buffer) encode() error {
+	image, g := b.image, b.gif
+	b.image, b.gif = nil, nil
+
+	switch {
+	case g != nil:
+		return gif.EncodeAll(&b.Buffer, g)
+	case image != nil:
+		// the byte budget only applies to the final encoding, without it
+		// the image is encoded once and there is no search to stop
+		options := b.options
+		options.MaxBytes = 0
+
+		return render(context.Background(), &b.Buffer, image, &options)
+	}
+
+	return nil
+}
+
+// Copy copies the source to the destination, images kept by a source
+// buffer are passed to a destination buffer without being encoded.
+func Copy(dst io.Writer, src io.Reader) error {
+	if from, ok := src.(*Buffer); ok {
+		if to, ok := dst.(*Buffer); ok && (from.image != nil || from.gif != nil) {
+			to.image, to.gif, to.options = from.image, from.gif, from.options
+			return nil
+		}
+	}
+
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// renderGIF encodes all frames of the GIF, they are kept decoded when
+// rendered to a buffer.
+func renderGIF(w io.Writer, g *gif.GIF) error {
+	if b, ok := w.(*Buffer); ok {
+		b.gif = g
+		return nil
+	}
+
+	return gif.EncodeAll(w, g)
+}
+
+// decodeAll decodes all frames of a GIF, a single image kept by a buffer
+// is converted to a single frame.
+func decodeAll(r io.Reader) (*gif.GIF, error) {
+	if b, ok := r.(*Buffer); ok {
+		switch {
+		case b.gif != nil:
+			g := b.gif
+			b.gif = nil
+			return g, nil
+		case b.image != nil:
+			frame := imageToPaletted(b.image)
+			b.image = nil
+			return &gif.GIF{
+				Image: []*image.Paletted{frame},
+				Delay: []int{0},
+				Config: image.Config{
+					ColorModel: frame.Palette,
+					Width:      frame.Bounds().Dx(),
+					Height:     frame.Bounds().Dy(),
+				},
+			}, nil
+		}
+	}
+
+	return gif.DecodeAll(r)
+}
+
+// kept returns the image kept by a buffer, the first frame of a GIF.
+func kept(r io.Reader) image.Image {
+	b, ok := r.(*Buffer)
+	if !ok {
+		return nil
+	}
+
+	if b.gif != nil && len(b.gif.Image) > 0 {
+		return b.gif.Image[0]
+	}
+
+	return b.image
+}
@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+
+	"github.com/go-spectest/imaging"
+	colorful "github.com/lucasb-eyer/go-colorful"
+
+	"github.com/thoas/picfit/constants"
+)
+
+// Default strengths, in percent, of the color effects.
+const (
+	defaultDuotoneStrength = 100
+	defaultTintStrength    = 50
+	defaultOverlayStrength = 50
+)
+
+// colorize applies the duotone, tint or overlay filter with the options color.
+func colorize(img image.Image, options *Options) (*image.NRGBA, error) {
+	var (
+		colors   = strings.Split(options.Color, ",")
+		parsed   = make([]colorful.Color, len(colors))
+		strength = options.Strength
+	)
+
+	for i := range colors {
+		c, err := ParseColor(colors[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid color %q for %s", colors[i], options.Filter)
+		}
+		parsed[i], _ = colorful.MakeColor(c)
+	}
+
+	var fn func(c colorful.Color, lum float64) colorful.Color
+	switch options.Filter {
+	case constants.FilterDuotone:
+		if strength == 0 {
+			strength = defaultDuotoneStrength
+		}
+
+		// the gradient goes from the first color in the shadows to the
+		// second one, white by default, in the highlights
+		shadows, highlights := parsed[0], colorful.Color{R: 1, G: 1, B: 1}
+		if len(parsed) > 1 {
+			highlights = parsed[1]
+		}
+
+		fn = func(_ colorful.Color, lum float64) colorful.Color {
+			return shadows.BlendRgb(highlights, lum)
+		}
+	case constants.FilterTint:
+		if strength == 0 {
+			strength = defaultTintStrength
+		}
+
+		// keep the lightness of the pixel with the hue and saturation of the color
+		h, s, _ := parsed[0].Hsl()
+		fn = func(c colorful.Color, _ float64) colorful.Color {
+			_, _, l := c.Hsl()
+			return colorful.Hsl(h, s, l)
+		}
+	case constants.FilterOverlay:
+		if strength == 0 {
+			strength = defaultOverlayStrength
+		}
+
+		fn = func(colorful.Color, float64) colorful.Color {
+			return parsed[0]
+		}
+	default:
+		return nil, MethodNotImplementedError
+	}
+
+	ratio := float64(strength) / 100
+
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		src := colorful.Color{R: float64(c.R) / 255, G: float64(c.G) / 255, B: float64(c.B) / 255}
+		lum := (0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)) / 255
+
+		r, g, b := src.BlendRgb(fn(src, lum), ratio).Clamped().RGB255()
+
+		return color.NRGBA{R: r, G: g, B: b, A: c.A}
+	}), nil
+}
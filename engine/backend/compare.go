@@ -0,0 +1,235 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/go-spectest/imaging"
+	colorful "github.com/lucasb-eyer/go-colorful"
+
+	imagefile "github.com/thoas/picfit/image"
+)
+
+const (
+	// ssimWindow is the size of the square window used to compute SSIM.
+	ssimWindow = 8
+	// ssimStride is the step between two SSIM windows.
+	ssimStride = 4
+	// maxPSNR is reported when both images are identical.
+	maxPSNR = 100
+)
+
+var (
+	ssimC1 = math.Pow(0.01*255, 2)
+	ssimC2 = math.Pow(0.03*255, 2)
+
+	defaultDiffColor = color.NRGBA{R: 255, A: 255}
+)
+
+// CompareOptions are the options used to compare two images.
+type CompareOptions struct {
+	Color     string
+	Format    imagefile.Format
+	Quality   int
+	Threshold int
+}
+
+// Comparison holds the similarity metrics between two images.
+type Comparison struct {
+	Height   int     `json:"height"`
+	Mismatch float64 `json:"mismatch"`
+	PSNR     float64 `json:"psnr"`
+	SSIM     float64 `json:"ssim"`
+	Width    int     `json:"width"`
+}
+
+// Compare computes similarity metrics between two images, the second image
+// is resized to the dimensions of the first one before being compared.
+// When dst is provided, a diff image highlighting changed pixels is written to it.
+func Compare(ctx context.Context, dst io.Writer, first *imagefile.ImageFile, second *imagefile.ImageFile, options *CompareOptions) (*Comparison, error) {
+	a, err := decode(first.Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := decode(second.Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("unable to compare an empty image")
+	}
+
+	left := imaging.Clone(a)
+	right := imaging.Clone(b)
+	if right.Bounds().Dx() != width || right.Bounds().Dy() != height {
+		right = imaging.Resize(right, width, height, imaging.Lanczos)
+	}
+
+	mse, mismatches := meanSquaredError(left, right, options.Threshold)
+
+	comparison := &Comparison{
+		Height:   height,
+		Mismatch: float64(mismatches) * 100 / float64(width*height),
+		PSNR:     psnr(mse),
+		SSIM:     ssim(luminance(left), luminance(right), width, height),
+		Width:    width,
+	}
+
+	if dst == nil {
+		return comparison, nil
+	}
+
+	c := defaultDiffColor
+	if options.Color != "" {
+		col, err := colorful.Hex(fmt.Sprintf("#%s", options.Color))
+		if err != nil {
+			return nil, err
+		}
+		c = color.NRGBAModel.Convert(col).(color.NRGBA)
+	}
+
+	if err := encode(dst, diffImage(left, right, options.Threshold, c), options.Format, options.Quality); err != nil {
+		return nil, err
+	}
+
+	return comparison, nil
+}
+
+// meanSquaredError returns the mean squared error computed on RGB channels
+// and the number of pixels which differ by more than the threshold.
+func meanSquaredError(a *image.NRGBA, b *image.NRGBA, threshold int) (float64, int) {
+	var (
+		sum        float64
+		mismatches int
+	)
+
+	for i := 0; i < len(a.Pix); i += 4 {
+		var delta int
+		for j := 0; j < 3; j++ {
+			d := int(a.Pix[i+j]) - int(b.Pix[i+j])
+			sum += float64(d * d)
+			delta = max(delta, abs(d))
+		}
+		delta = max(delta, abs(int(a.Pix[i+3])-int(b.Pix[i+3])))
+		if delta > threshold {
+			mismatches++
+		}
+	}
+
+	return sum / float64(len(a.Pix)/4*3), mismatches
+}
+
+func psnr(mse float64) float64 {
+	if mse == 0 {
+		return maxPSNR
+	}
+
+	return min(maxPSNR, 10*math.Log10(255*255/mse))
+}
+
+// luminance converts an image to its luma channel.
+func luminance(img *image.NRGBA) []float64 {
+	lum := make([]float64, len(img.Pix)/4)
+	for i := range lum {
+		p := img.Pix[i*4 : i*4+3]
+		lum[i] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+	}
+	return lum
+}
+
+// ssim computes the mean structural similarity index of two luma channels
+// using sliding windows.
+func ssim(a []float64, b []float64, width int, height int) float64 {
+	window := min(ssimWindow, width, height)
+
+	var (
+		total float64
+		count int
+	)
+
+	for y := 0; y+window <= height; y += ssimStride {
+		for x := 0; x+window <= width; x += ssimStride {
+			total += ssimWindowIndex(a, b, width, x, y, window)
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 1
+	}
+
+	return total / float64(count)
+}
+
+func ssimWindowIndex(a []float64, b []float64, stride int, x0 int, y0 int, window int) float64 {
+	var (
+		n                  = float64(window * window)
+		meanA, meanB       float64
+		varA, varB, covary float64
+	)
+
+	for y := y0; y < y0+window; y++ {
+		for x := x0; x < x0+window; x++ {
+			meanA += a[y*stride+x]
+			meanB += b[y*stride+x]
+		}
+	}
+	meanA /= n
+	meanB /= n
+
+	for y := y0; y < y0+window; y++ {
+		for x := x0; x < x0+window; x++ {
+			da := a[y*stride+x] - meanA
+			db := b[y*stride+x] - meanB
+			varA += da * da
+			varB += db * db
+			covary += da * db
+		}
+	}
+	varA /= n - 1
+	varB /= n - 1
+	covary /= n - 1
+
+	return ((2*meanA*meanB + ssimC1) * (2*covary + ssimC2)) /
+		((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+}
+
+// diffImage draws a faded grayscale version of the first image where pixels
+// which differ from the second image are highlighted with the given color.
+func diffImage(a *image.NRGBA, b *image.NRGBA, threshold int, c color.NRGBA) *image.NRGBA {
+	diff := image.NewNRGBA(a.Bounds())
+
+	for i := 0; i < len(a.Pix); i += 4 {
+		var delta int
+		for j := 0; j < 4; j++ {
+			delta = max(delta, abs(int(a.Pix[i+j])-int(b.Pix[i+j])))
+		}
+
+		if delta > threshold {
+			diff.Pix[i], diff.Pix[i+1], diff.Pix[i+2], diff.Pix[i+3] = c.R, c.G, c.B, 255
+			continue
+		}
+
+		// fade the luma towards white, transparent pixels end up white
+		lum := 0.299*float64(a.Pix[i]) + 0.587*float64(a.Pix[i+1]) + 0.114*float64(a.Pix[i+2])
+		alpha := float64(a.Pix[i+3]) / 255
+		v := uint8(255 - (255-lum)*alpha*0.3)
+		diff.Pix[i], diff.Pix[i+1], diff.Pix[i+2], diff.Pix[i+3] = v, v, v, 255
+	}
+
+	return diff
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/go-spectest/imaging"
+
+	"github.com/thoas/picfit/constants"
+)
+
+// levelsClip is the ratio of the darkest and brightest pixels ignored
+// when stretching levels, so a few outliers do not prevent the stretch.
+const levelsClip = 0.005
+
+// enhance applies the automatic enhancement defined by the mode, auto-levels by default.
+func enhance(img image.Image, mode string) *image.NRGBA {
+	dst := imaging.Clone(img)
+
+	switch mode {
+	case constants.EnhanceEqualize:
+		equalize(dst)
+	case constants.EnhanceWhiteBalance:
+		whiteBalance(dst)
+	default:
+		levels(dst)
+	}
+
+	return dst
+}
+
+// levels stretches each channel so its histogram covers the full range.
+func levels(img *image.NRGBA) {
+	var (
+		histograms [3][256]int
+		total      int
+	)
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			histograms[c][img.Pix[i+c]]++
+		}
+		total++
+	}
+
+	if total == 0 {
+		return
+	}
+
+	var lookups [3][256]uint8
+	for c := range histograms {
+		low, high := percentile(histograms[c], total, levelsClip), percentile(histograms[c], total, 1-levelsClip)
+		for v := range lookups[c] {
+			if high <= low {
+				lookups[c][v] = uint8(v)
+				continue
+			}
+			lookups[c][v] = clampUint8(float64(v-low) * 255 / float64(high-low))
+		}
+	}
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = lookups[c][img.Pix[i+c]]
+		}
+	}
+}
+
+// equalize equalizes the histogram of the luma, chroma is kept.
+func equalize(img *image.NRGBA) {
+	var (
+		histogram [256]int
+		total     int
+	)
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		y, _, _ := color.RGBToYCbCr(img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+		histogram[y]++
+		total++
+	}
+
+	if total == 0 {
+		return
+	}
+
+	var (
+		lookup [256]uint8
+		cdf    int
+		cdfMin int
+	)
+	for v := range histogram {
+		cdf += histogram[v]
+		if cdfMin == 0 {
+			cdfMin = cdf
+		}
+		if total == cdfMin {
+			lookup[v] = uint8(v)
+			continue
+		}
+		lookup[v] = clampUint8(float64(cdf-cdfMin) * 255 / float64(total-cdfMin))
+	}
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		y, cb, cr := color.RGBToYCbCr(img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = color.YCbCrToRGB(lookup[y], cb, cr)
+	}
+}
+
+// whiteBalance applies the gray world assumption: channels are scaled so
+// their averages are equal.
+func whiteBalance(img *image.NRGBA) {
+	var (
+		sums  [3]float64
+		total float64
+	)
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			sums[c] += float64(img.Pix[i+c])
+		}
+		total++
+	}
+
+	if total == 0 || sums[0] == 0 || sums[1] == 0 || sums[2] == 0 {
+		return
+	}
+
+	var (
+		gray    = (sums[0] + sums[1] + sums[2]) / 3
+		lookups [3][256]uint8
+	)
+	for c := range lookups {
+		gain := gray / sums[c]
+		for v := range lookups[c] {
+			lookups[c][v] = clampUint8(float64(v) * gain)
+		}
+	}
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = lookups[c][img.Pix[i+c]]
+		}
+	}
+}
+
+// percentile returns the smallest value for which the cumulated histogram
+// reaches the given ratio of the total.
+func percentile(histogram [256]int, total int, ratio float64) int {
+	var (
+		threshold = int(math.Ceil(float64(total) * ratio))
+		cumulated int
+	)
+
+	for v, count := range histogram {
+		cumulated += count
+		if cumulated >= threshold {
+			return v
+		}
+	}
+
+	return len(histogram) - 1
+}
+
+func clampUint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
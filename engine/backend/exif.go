@@ -88,3 +88,25 @@ func getOrientation(reader io.Reader) string {
 
 	return "1"
 }
+
+// DecodeConfig returns the dimensions of an image without decoding it entirely,
+// dimensions are swapped when the EXIF orientation rotates the image.
+func DecodeConfig(reader io.Reader) (image.Config, error) {
+	header := make([]byte, 65536)
+	n, err := io.ReadFull(reader, header)
+	if err != nil && err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return image.Config{}, errors.WithStack(err)
+	}
+
+	cfg, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(header[:n]), reader))
+	if err != nil {
+		return image.Config{}, errors.WithStack(err)
+	}
+
+	switch getOrientation(bytes.NewReader(header[:n])) {
+	case "5", "6", "7", "8":
+		cfg.Width, cfg.Height = cfg.Height, cfg.Width
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,153 @@
+package backend
+
+import (
+	_ "embed"
+	"image"
+	"image/draw"
+	"sort"
+
+	pigo "github.com/esimov/pigo/core"
+	"github.com/go-spectest/imaging"
+)
+
+const (
+	// faceDetectionSize is the maximum dimension of the image analyzed
+	// to detect faces, bigger images are downscaled first.
+	faceDetectionSize = 400
+
+	// faceMinSize and faceMaxSize bound the width of a face relative to the
+	// smallest dimension of the image.
+	faceMinSize = 0.08
+	faceMaxSize = 1.0
+	// faceMinQuality is the minimum score of a detection returned by the cascade.
+	faceMinQuality = 5.0
+	// faceMaxIoU is the intersection over union above which two detections
+	// are merged into a single face.
+	faceMaxIoU = 0.2
+	// faceMaxOverlap is the maximum overlap of two faces, relative to the smallest one.
+	faceMaxOverlap = 0.3
+
+	// faceMargin is the margin added around a face before blurring it.
+	faceMargin = 0.2
+)
+
+// facefinder is the pico face detection cascade shipped with pigo.
+//
+//go:embed cascade/facefinder
+var facefinder []byte
+
+var faceClassifier = func() *pigo.Pigo {
+	classifier, err := pigo.NewPigo().Unpack(facefinder)
+	if err != nil {
+		panic(err)
+	}
+
+	return classifier
+}()
+
+// detectFaces returns the bounding boxes of the faces found in the image,
+// sorted by decreasing confidence.
+//
+// The detection runs the pico cascade of decision trees on the luminance
+// of the image, so it works on color and grayscale pictures alike.
+func detectFaces(img image.Image) []image.Rectangle {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil
+	}
+
+	var (
+		small  = img
+		factor = 1.0
+	)
+	if size := max(bounds.Dx(), bounds.Dy()); size > faceDetectionSize {
+		factor = float64(size) / faceDetectionSize
+		small = imaging.Fit(img, faceDetectionSize, faceDetectionSize, imaging.Box)
+	}
+
+	var (
+		src           = imaging.Clone(small)
+		width, height = src.Bounds().Dx(), src.Bounds().Dy()
+		side          = float64(min(width, height))
+	)
+
+	detections := faceClassifier.RunCascade(pigo.CascadeParams{
+		MinSize:     max(20, int(side*faceMinSize)),
+		MaxSize:     int(side * faceMaxSize),
+		ShiftFactor: 0.1,
+		ScaleFactor: 1.1,
+		ImageParams: pigo.ImageParams{
+			Pixels: pigo.RgbToGrayscale(src),
+			Rows:   height,
+			Cols:   width,
+			Dim:    width,
+		},
+	}, 0)
+	detections = faceClassifier.ClusterDetections(detections, faceMaxIoU)
+
+	sort.SliceStable(detections, func(i, j int) bool {
+		return detections[i].Q > detections[j].Q
+	})
+
+	var faces []image.Rectangle
+	for _, detection := range detections {
+		if detection.Q < faceMinQuality {
+			break
+		}
+
+		half := float64(detection.Scale) / 2
+		face := image.Rect(
+			bounds.Min.X+int((float64(detection.Col)-half)*factor),
+			bounds.Min.Y+int((float64(detection.Row)-half)*factor),
+			bounds.Min.X+int((float64(detection.Col)+half)*factor+0.5),
+			bounds.Min.Y+int((float64(detection.Row)+half)*factor+0.5),
+		).Intersect(bounds)
+		if face.Empty() {
+			continue
+		}
+
+		var overlaps bool
+		for i := range faces {
+			if overlap(faces[i], face) > faceMaxOverlap {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			faces = append(faces, face)
+		}
+	}
+
+	return faces
+}
+
+// overlap returns the area of the intersection of two rectangles relative
+// to the area of the smallest one.
+func overlap(a image.Rectangle, b image.Rectangle) float64 {
+	inter := a.Intersect(b)
+	if inter.Empty() {
+		return 0
+	}
+
+	return float64(inter.Dx()*inter.Dy()) / float64(min(a.Dx()*a.Dy(), b.Dx()*b.Dy()))
+}
+
+// blurFaces blurs every face found in the image.
+func blurFaces(img image.Image) *image.NRGBA {
+	dst := imaging.Clone(img)
+
+	for _, face := range detectFaces(dst) {
+		margin := image.Point{
+			X: int(float64(face.Dx()) * faceMargin),
+			Y: int(float64(face.Dy()) * faceMargin),
+		}
+		r := image.Rectangle{face.Min.Sub(margin), face.Max.Add(margin)}.Intersect(dst.Bounds())
+
+		sigma := float64(max(r.Dx(), r.Dy())) / 8
+		blurred := imaging.Blur(imaging.Crop(dst, r), sigma)
+
+		draw.Draw(dst, r, blurred, image.Point{}, draw.Src)
+	}
+
+	return dst
+}
@@ -9,6 +9,7 @@ import (
 	"os/exec"
 
 	"github.com/pkg/errors"
+	"github.com/thoas/picfit/constants"
 	"github.com/thoas/picfit/image"
 )
 
@@ -17,6 +18,15 @@ type Gifsicle struct {
 	Path string
 }
 
+var resizeMethods = map[string]string{
+	constants.ResampleNearest:    "sample",
+	constants.ResampleBox:        "box",
+	constants.ResampleLinear:     "mix",
+	constants.ResampleCatmullRom: "catrom",
+	constants.ResampleMitchell:   "mitchell",
+	constants.ResampleLanczos:    "lanczos3",
+}
+
 func (b *Gifsicle) String() string {
 	return "gifsicle"
 }
@@ -39,9 +49,9 @@ func (b *Gifsicle) Resize(ctx context.Context, dst io.Writer, imgfile *image.Ima
 	}
 
 	resizeOption := fmt.Sprintf("%dx%d", opts.Width, opts.Height)
-	cmd := exec.CommandContext(ctx, b.Path,
+	cmd := exec.CommandContext(ctx, b.Path, append(resizeMethodArgs(opts),
 		"--resize", resizeOption,
-	)
+	)...)
 	cmd.Stdin = bytes.NewReader(data)
 	cmd.Stdout = dst
 	stderr := new(bytes.Buffer)
@@ -56,8 +66,24 @@ func (b *Gifsicle) Resize(ctx context.Context, dst io.Writer, imgfile *image.Ima
 	return nil
 }
 
+// resizeMethodArgs returns the gifsicle arguments selecting the resampling
+// method, gifsicle default is kept when none is requested.
+func resizeMethodArgs(opts *Options) []string {
+	method, ok := resizeMethods[opts.Resample]
+	if !ok {
+		return nil
+	}
+
+	return []string{"--resize-method", method}
+}
+
 // Thumbnail implements Backend.
 func (b *Gifsicle) Thumbnail(ctx context.Context, dst io.Writer, imgfile *image.ImageFile, opts *Options) error {
+	// gifsicle only crops around the center
+	if opts.FocalPoint != nil || opts.Gravity == constants.GravityFace {
+		return MethodNotImplementedError
+	}
+
 	data, err := io.ReadAll(imgfile.Stream)
 	if err != nil {
 		return errors.WithStack(err)
@@ -78,10 +104,10 @@ func (b *Gifsicle) Thumbnail(ctx context.Context, dst io.Writer, imgfile *image.
 	cropOption := fmt.Sprintf("%d,%d+%dx%d", left, top, cropw, croph)
 	resizeOption := fmt.Sprintf("%dx%d", opts.Width, opts.Height)
 
-	cmd := exec.CommandContext(ctx, b.Path,
+	cmd := exec.CommandContext(ctx, b.Path, append(resizeMethodArgs(opts),
 		"--crop", cropOption,
 		"--resize", resizeOption,
-	)
+	)...)
 
 	cmd.Stdin = bytes.NewReader(data)
 	cmd.Stdout = dst
@@ -97,6 +123,36 @@ func (b *Gifsicle) Thumbnail(ctx context.Context, dst io.Writer, imgfile *image.
 	return nil
 }
 
+// Barcode implements Backend.
+func (b *Gifsicle) Barcode(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error {
+	return MethodNotImplementedError
+}
+
+// Border implements Backend.
+func (b *Gifsicle) Border(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error {
+	return MethodNotImplementedError
+}
+
+// Collage implements Backend.
+func (b *Gifsicle) Collage(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error {
+	return MethodNotImplementedError
+}
+
+// Crop implements Backend.
+func (b *Gifsicle) Crop(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error {
+	return MethodNotImplementedError
+}
+
+// Liquid implements Backend.
+func (b *Gifsicle) Liquid(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error {
+	return MethodNotImplementedError
+}
+
+// Redact implements Backend.
+func (b *Gifsicle) Redact(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error {
+	return MethodNotImplementedError
+}
+
 // Rotate implements Backend.
 func (b *Gifsicle) Rotate(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error {
 	return MethodNotImplementedError
@@ -117,6 +173,11 @@ func (b *Gifsicle) Flat(ctx context.Context, dst io.Writer, img *image.ImageFile
 	return MethodNotImplementedError
 }
 
+// Flatten implements Backend.
+func (b *Gifsicle) Flatten(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error {
+	return MethodNotImplementedError
+}
+
 // Flip implements Backend.
 func (b *Gifsicle) Flip(ctx context.Context, dst io.Writer, img *image.ImageFile, options *Options) error {
 	return MethodNotImplementedError
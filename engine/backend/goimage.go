@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"image"
@@ -15,6 +16,7 @@ import (
 	"github.com/thoas/picfit/constants"
 
 	"github.com/go-spectest/imaging"
+	"github.com/pkg/errors"
 
 	imagefile "github.com/thoas/picfit/image"
 
@@ -39,19 +41,35 @@ var (
 		270: imaging.Rotate270,
 		180: imaging.Rotate180,
 	}
+
+	resampleFilters = map[string]imaging.ResampleFilter{
+		constants.ResampleNearest:    imaging.NearestNeighbor,
+		constants.ResampleBox:        imaging.Box,
+		constants.ResampleLinear:     imaging.Linear,
+		constants.ResampleCatmullRom: imaging.CatmullRom,
+		constants.ResampleMitchell:   imaging.MitchellNetravali,
+		constants.ResampleLanczos:    imaging.Lanczos,
+	}
 )
 
-type GoImage struct{}
+type GoImage struct {
+	// MaxLiquidPixels is the maximum number of pixels carved by Liquid.
+	MaxLiquidPixels int
+}
 
 func (e *GoImage) String() string {
 	return "goimage"
 }
 func (e *GoImage) Resize(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
-	return e.resize(dst, img, options, imaging.Resize)
+	return e.resize(ctx, dst, img, options, resizeContext(ctx))
 }
 
 func (e *GoImage) Thumbnail(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
-	return e.resize(dst, img, options, imaging.Thumbnail)
+	if hasAnchor(options) {
+		return e.resize(ctx, dst, img, options, anchored(options, fillAt))
+	}
+
+	return e.resize(ctx, dst, img, options, thumbnailContext(ctx))
 }
 
 func (e *GoImage) Rotate(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
@@ -67,7 +85,7 @@ func (e *GoImage) Rotate(ctx context.Context, dst io.Writer, img *imagefile.Imag
 		return fmt.Errorf("Invalid rotate transformation degree=%d is not supported", deg)
 	}
 
-	return encode(dst, transform(image), options.Format, options.Quality)
+	return render(ctx, dst, transform(image), options)
 }
 
 func (e *GoImage) Flip(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
@@ -83,12 +101,17 @@ func (e *GoImage) Flip(ctx context.Context, dst io.Writer, img *imagefile.ImageF
 		return fmt.Errorf("Invalid flip transformation, %s is not supported", pos)
 	}
 
-	return encode(dst, transform(image), options.Format, options.Quality)
+	return render(ctx, dst, transform(image), options)
 }
 
 func (e *GoImage) Fit(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
 	if options.Format == imagefile.GIF {
-		err := e.transformGIF(dst, img, options, imaging.Thumbnail)
+		trans := transformation(imaging.Thumbnail)
+		if hasAnchor(options) {
+			trans = anchored(options, fillAt)
+		}
+
+		err := e.transformGIF(ctx, dst, img, options, trans)
 		if err != nil {
 			return err
 		}
@@ -101,7 +124,7 @@ func (e *GoImage) Fit(ctx context.Context, dst io.Writer, img *imagefile.ImageFi
 		return err
 	}
 
-	return e.transform(dst, image, options, imaging.Fit)
+	return e.transform(ctx, dst, image, options, fitContext(ctx))
 }
 
 func (e *GoImage) Effect(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
@@ -119,14 +142,24 @@ func (e *GoImage) Effect(ctx context.Context, dst io.Writer, img *imagefile.Imag
 	}
 	switch options.Filter {
 	case constants.FilterBlur:
-		return encode(dst, imaging.Blur(image, float64(sigma)), options.Format, options.Quality)
+		return render(ctx, dst, imaging.Blur(image, float64(sigma)), options)
+	case constants.FilterBlurFaces:
+		return render(ctx, dst, blurFaces(image), options)
+	case constants.FilterEnhance:
+		return render(ctx, dst, enhance(image, options.Mode), options)
+	case constants.FilterDuotone, constants.FilterTint, constants.FilterOverlay:
+		colorized, err := colorize(image, options)
+		if err != nil {
+			return err
+		}
+		return render(ctx, dst, colorized, options)
 	}
 
 	return MethodNotImplementedError
 }
 
-func (e *GoImage) transformGIF(dst io.Writer, img *imagefile.ImageFile, options *Options, trans transformation) error {
-	g, err := gif.DecodeAll(img.Stream)
+func (e *GoImage) transformGIF(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options, trans transformation) error {
+	g, err := decodeAll(img.Stream)
 	if err != nil {
 		return err
 	}
@@ -140,7 +173,7 @@ func (e *GoImage) transformGIF(dst io.Writer, img *imagefile.ImageFile, options
 	first := g.Image[0]
 	factor := scalingFactorImage(first, options.Width, options.Height)
 	if factor > 1 && !options.Upscale {
-		return gif.EncodeAll(dst, g)
+		return renderGIF(dst, g)
 	}
 
 	firstFrame := g.Image[0].Bounds()
@@ -150,7 +183,11 @@ func (e *GoImage) transformGIF(dst io.Writer, img *imagefile.ImageFile, options
 	for i, frame := range g.Image {
 		bounds := frame.Bounds()
 		draw.Draw(im, bounds, frame, bounds.Min, draw.Over)
-		g.Image[i] = imageToPaletted(scale(im, options, trans))
+		scaled := scale(im, options, trans)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		g.Image[i] = imageToPaletted(scaled)
 	}
 
 	srcW, srcH := imageSize(first)
@@ -167,16 +204,16 @@ func (e *GoImage) transformGIF(dst io.Writer, img *imagefile.ImageFile, options
 	g.Config.Height = options.Height
 	g.Config.Width = options.Width
 
-	if err := gif.EncodeAll(dst, g); err != nil {
+	if err := renderGIF(dst, g); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (e *GoImage) resize(dst io.Writer, img *imagefile.ImageFile, options *Options, trans transformation) error {
+func (e *GoImage) resize(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options, trans transformation) error {
 	if options.Format == imagefile.GIF {
-		err := e.transformGIF(dst, img, options, trans)
+		err := e.transformGIF(ctx, dst, img, options, trans)
 		if err != nil {
 			return err
 		}
@@ -189,21 +226,47 @@ func (e *GoImage) resize(dst io.Writer, img *imagefile.ImageFile, options *Optio
 		return err
 	}
 
-	return e.transform(dst, image, options, trans)
+	return e.transform(ctx, dst, image, options, trans)
 }
 
-func (e *GoImage) transform(dst io.Writer, img image.Image, options *Options, trans transformation) error {
+func (e *GoImage) transform(ctx context.Context, dst io.Writer, img image.Image, options *Options, trans transformation) error {
 	if options.Height == 0 && options.Width == 0 {
-		return encode(dst, img, options.Format, options.Quality)
+		return render(ctx, dst, img, options)
+	}
+
+	// cancelled transformations return early with an incomplete image
+	scaled := scale(img, options, trans)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	return encode(dst, scale(img, options, trans), options.Format, options.Quality)
+	return render(ctx, dst, scaled, options)
 }
 
 func (e *GoImage) source(img *imagefile.ImageFile) (image.Image, error) {
+	if image := kept(img.Stream); image != nil {
+		return image, nil
+	}
+
 	return decode(img.Stream)
 }
 
+// sourceConfig returns the dimensions of the image without decoding it,
+// the stream is buffered to be read again.
+func (e *GoImage) sourceConfig(img *imagefile.ImageFile) (image.Config, error) {
+	if kept := kept(img.Stream); kept != nil {
+		return image.Config{Width: kept.Bounds().Dx(), Height: kept.Bounds().Dy()}, nil
+	}
+
+	data, err := io.ReadAll(img.Stream)
+	if err != nil {
+		return image.Config{}, errors.WithStack(err)
+	}
+	img.Stream = io.NopCloser(bytes.NewReader(data))
+
+	return DecodeConfig(bytes.NewReader(data))
+}
+
 func scalingFactor(srcWidth int, srcHeight int, destWidth int, destHeight int) float64 {
 	return max(float64(destWidth)/float64(srcWidth), float64(destHeight)/float64(srcHeight))
 }
@@ -222,12 +285,21 @@ func scale(img image.Image, options *Options, trans transformation) image.Image
 	factor := scalingFactorImage(img, options.Width, options.Height)
 
 	if factor < 1 || options.Upscale {
-		return trans(img, options.Width, options.Height, imaging.Lanczos)
+		return trans(img, options.Width, options.Height, resampleFilter(options))
 	}
 
 	return img
 }
 
+// resampleFilter returns the filter used to scale the image, Lanczos by default.
+func resampleFilter(options *Options) imaging.ResampleFilter {
+	if filter, ok := resampleFilters[options.Resample]; ok {
+		return filter
+	}
+
+	return imaging.Lanczos
+}
+
 func imageToPaletted(img image.Image) *image.Paletted {
 	b := img.Bounds()
 	pm := image.NewPaletted(b, palette.Plan9)
@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
+	"github.com/go-spectest/imaging"
+
+	"github.com/thoas/picfit/constants"
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// Quiet zones, in modules, required around codes to be scannable.
+const (
+	qrQuietZone      = 4
+	code128QuietZone = 10
+)
+
+// Barcode draws a code generated from the options text at the options
+// stick corner or inside the options position, like Flat.
+func (e *GoImage) Barcode(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
+	code, err := barcodeImage(options.Text, options.Mode)
+	if err != nil {
+		return err
+	}
+
+	// codes are scaled without interpolation to keep modules sharp
+	opts := *options
+	if opts.Resample == "" {
+		opts.Resample = constants.ResampleNearest
+	}
+	if opts.Stick == "" && opts.Position == "" {
+		opts.Stick = constants.BottomRight
+	}
+
+	// frames of optimized GIFs only cover a part of the image, the code is
+	// drawn on the composited frames to be positioned on the full image
+	if options.Format == imagefile.GIF {
+		return e.transformFrames(ctx, dst, img, func(frame image.Image) (image.Image, error) {
+			bg := imaging.Clone(frame)
+			if err := drawBarcode(bg, code, &opts); err != nil {
+				return nil, err
+			}
+
+			return bg, nil
+		})
+	}
+
+	background, err := e.source(img)
+	if err != nil {
+		return err
+	}
+
+	bg, ok := background.(draw.Image)
+	if !ok {
+		bg = image.NewRGBA(image.Rectangle{image.Point{}, background.Bounds().Size()})
+		draw.Draw(bg, background.Bounds(), background, image.Point{}, draw.Src)
+	}
+
+	if err := drawBarcode(bg, code, &opts); err != nil {
+		return err
+	}
+
+	return render(ctx, dst, bg, options)
+}
+
+// drawBarcode scales the code by a whole number of pixels per module
+// then draws it at the stick corner or centered inside the position,
+// the position must fit at least one pixel per module.
+func drawBarcode(bg draw.Image, code image.Image, options *Options) error {
+	if options.Stick != "" {
+		width := options.Width
+		if width == 0 {
+			width = min(bg.Bounds().Dx(), bg.Bounds().Dy()) / 4
+		}
+
+		code = scaleBarcode(code, width, options.Height)
+
+		opts := *options
+		opts.Width, opts.Height = code.Bounds().Dx(), code.Bounds().Dy()
+
+		drawStickForeground(bg, []image.Image{code}, &opts)
+		return nil
+	}
+
+	r := positionForeground(bg, options.Position).Canon()
+	size := code.Bounds().Size()
+	if r.Dx() < size.X || r.Dy() < size.Y {
+		return fmt.Errorf("position %q of %dx%d pixels is smaller than the code of %dx%d modules",
+			options.Position, r.Dx(), r.Dy(), size.X, size.Y)
+	}
+
+	if options.Color != "" {
+		col, err := ParseColor(options.Color)
+		if err != nil {
+			return err
+		}
+		draw.Draw(bg, r, &image.Uniform{col}, image.Point{}, draw.Over)
+	}
+
+	code = scaleBarcode(code, r.Dx(), r.Dy())
+	size = code.Bounds().Size()
+	at := r.Min.Add(r.Size().Sub(size).Div(2))
+
+	draw.Draw(bg, image.Rectangle{at, at.Add(size)}, code, code.Bounds().Min, draw.Over)
+	return nil
+}
+
+// scaleBarcode scales the code by the largest whole factor fitting the
+// given dimensions, a zero height is not taken into account.
+func scaleBarcode(code image.Image, width int, height int) image.Image {
+	b := code.Bounds()
+	factor := width / b.Dx()
+	if height > 0 {
+		factor = min(factor, height/b.Dy())
+	}
+	factor = max(1, factor)
+
+	return imaging.Resize(code, b.Dx()*factor, b.Dy()*factor, imaging.NearestNeighbor)
+}
+
+// barcodeImage generates a code of one pixel per module surrounded by
+// its quiet zone, a QR code by default.
+func barcodeImage(text string, mode string) (*image.NRGBA, error) {
+	var (
+		code  barcode.Barcode
+		quiet int
+		err   error
+	)
+
+	switch mode {
+	case constants.BarcodeCode128:
+		code, err = code128.Encode(text)
+		quiet = code128QuietZone
+	default:
+		code, err = qr.Encode(text, qr.M, qr.Auto)
+		quiet = qrQuietZone
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := code.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if b.Dy() == 1 {
+		// linear codes are a single row of modules
+		height = max(1, width/4)
+	}
+
+	dst := imaging.New(width+2*quiet, height+2*quiet, color.White)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(quiet+x, quiet+y, code.At(b.Min.X+x, b.Min.Y+min(y, b.Dy()-1)))
+		}
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+
+	"github.com/go-spectest/imaging"
+
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// shadowOpacity is the opacity of the drop shadow.
+const shadowOpacity = 0.5
+
+func (e *GoImage) Border(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
+	fill := color.Color(color.White)
+	if options.Color != "" {
+		col, err := ParseColor(options.Color)
+		if err != nil {
+			return err
+		}
+		fill = col
+	}
+
+	trans := func(img image.Image) (image.Image, error) {
+		return dropShadow(border(img, options.Border, fill), options.Shadow), nil
+	}
+
+	if options.Format == imagefile.GIF {
+		return e.transformFrames(ctx, dst, img, trans)
+	}
+
+	image, err := e.source(img)
+	if err != nil {
+		return err
+	}
+
+	return render(ctx, dst, dropShadow(border(image, options.Border, fill), options.Shadow), options)
+}
+
+// border surrounds the image with the given widths of the fill color,
+// the transparency of the image is kept.
+func border(img image.Image, widths *Border, fill color.Color) *image.NRGBA {
+	if widths == nil {
+		return imaging.Clone(img)
+	}
+
+	b := img.Bounds()
+	width := widths.Left + b.Dx() + widths.Right
+	height := widths.Top + b.Dy() + widths.Bottom
+
+	dst := imaging.New(width, height, fill)
+	inner := image.Rect(widths.Left, widths.Top, widths.Left+b.Dx(), widths.Top+b.Dy())
+	draw.Draw(dst, inner, img, b.Min, draw.Src)
+
+	return dst
+}
+
+// dropShadow draws the image over a blurred shadow offset to the bottom
+// right, the image is extended by the given size on these sides.
+func dropShadow(img *image.NRGBA, size int) *image.NRGBA {
+	if size <= 0 {
+		return img
+	}
+
+	b := img.Bounds()
+	offset := size / 2
+
+	shadow := imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{A: uint8(float64(c.A) * shadowOpacity)}
+	})
+
+	dst := imaging.New(b.Dx()+size, b.Dy()+size, color.Transparent)
+	dst = imaging.Overlay(dst, shadow, image.Pt(offset, offset), 1)
+	dst = imaging.Blur(dst, float64(size)/4)
+
+	return imaging.Overlay(dst, img, image.Point{}, 1)
+}
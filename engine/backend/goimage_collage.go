@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/go-spectest/imaging"
+
+	"github.com/thoas/picfit/constants"
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// Collage arranges the image followed by the options images into the cells
+// of the options layout, a grid by default.
+func (e *GoImage) Collage(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
+	first, err := e.source(img)
+	if err != nil {
+		return err
+	}
+
+	images := []image.Image{first}
+	for i := range options.Images {
+		image, err := e.source(&options.Images[i])
+		if err != nil {
+			return err
+		}
+		images = append(images, image)
+	}
+
+	background := color.Color(color.Transparent)
+	if options.Color != "" {
+		col, err := ParseColor(options.Color)
+		if err != nil {
+			return err
+		}
+		background = col
+	}
+
+	width, height := options.Width, options.Height
+	if width == 0 {
+		width = first.Bounds().Dx()
+	}
+	if height == 0 {
+		height = first.Bounds().Dy()
+	}
+
+	canvas := imaging.New(width, height, background)
+
+	cells, err := collageCells(canvas.Bounds(), collageLayout(options.Layout, len(images)), options.Gutter)
+	if err != nil {
+		return err
+	}
+
+	modes := strings.Split(options.Mode, ".")
+	for i := range cells {
+		if i >= len(images) {
+			break
+		}
+
+		mode := modes[min(i, len(modes)-1)]
+		cell := collageCell(images[i], cells[i].Dx(), cells[i].Dy(), mode, options)
+
+		// cells are centered when the image does not fill them
+		offset := cells[i].Size().Sub(cell.Bounds().Size()).Div(2)
+		draw.Draw(canvas, cells[i].Add(offset), cell, image.Point{}, draw.Over)
+	}
+
+	return render(ctx, dst, canvas, options)
+}
+
+// collageLayout returns the number of cells of each row, when no layout is
+// given the images are arranged in a grid as square as possible.
+func collageLayout(layout []int, n int) []int {
+	if len(layout) > 0 {
+		return layout
+	}
+
+	columns := int(math.Ceil(math.Sqrt(float64(n))))
+	layout = make([]int, 0, (n+columns-1)/columns)
+	for n > 0 {
+		layout = append(layout, min(n, columns))
+		n -= columns
+	}
+
+	return layout
+}
+
+// collageCells splits the bounds into rows of cells separated by the gutter,
+// rows are laid out from top to bottom and cells from left to right.
+func collageCells(bounds image.Rectangle, layout []int, gutter int) ([]image.Rectangle, error) {
+	var (
+		rows   = len(layout)
+		height = bounds.Dy() - gutter*(rows+1)
+		cells  []image.Rectangle
+	)
+
+	for r, columns := range layout {
+		width := bounds.Dx() - gutter*(columns+1)
+		if width < columns || height < rows {
+			return nil, fmt.Errorf("collage of %dx%d is too small for its layout and gutter", bounds.Dx(), bounds.Dy())
+		}
+
+		top := gutter*(r+1) + r*height/rows
+		bottom := gutter*(r+1) + (r+1)*height/rows
+
+		for c := 0; c < columns; c++ {
+			left := gutter*(c+1) + c*width/columns
+			right := gutter*(c+1) + (c+1)*width/columns
+
+			cells = append(cells, image.Rect(left, top, right, bottom).Add(bounds.Min))
+		}
+	}
+
+	return cells, nil
+}
+
+// collageCell scales the image to the cell, it is cropped to cover the
+// cell in fill mode and fully contained in fit mode.
+func collageCell(img image.Image, width int, height int, mode string, options *Options) *image.NRGBA {
+	filter := resampleFilter(options)
+
+	if mode == constants.CollageFit {
+		b := img.Bounds()
+		factor := min(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+
+		return imaging.Resize(img,
+			max(1, int(math.Round(float64(b.Dx())*factor))),
+			max(1, int(math.Round(float64(b.Dy())*factor))),
+			filter)
+	}
+
+	x, y := anchor(img, &Options{Gravity: options.Gravity})
+
+	return fillAt(img, width, height, x, y, filter)
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/go-spectest/imaging"
+)
+
+// resizeBand is the number of rows, or columns, resized between two
+// checks of the context.
+const resizeBand = 64
+
+// resizeContext returns imaging.Resize stopping when the context is done,
+// the image returned is then incomplete.
+func resizeContext(ctx context.Context) transformation {
+	return func(img image.Image, width int, height int, filter imaging.ResampleFilter) *image.NRGBA {
+		return resizeBanded(ctx, img, width, height, filter)
+	}
+}
+
+// thumbnailContext returns imaging.Thumbnail stopping when the context is done.
+func thumbnailContext(ctx context.Context) transformation {
+	return func(img image.Image, width int, height int, filter imaging.ResampleFilter) *image.NRGBA {
+		b := img.Bounds()
+		if width <= 0 || height <= 0 || b.Dx() < 100 || b.Dy() < 100 {
+			return imaging.Thumbnail(img, width, height, filter)
+		}
+
+		// same crop as imaging.Fill before resizing
+		var cropped *image.NRGBA
+		if float64(b.Dx())/float64(b.Dy()) < float64(width)/float64(height) {
+			cropHeight := float64(b.Dx()) * float64(height) / float64(width)
+			cropped = imaging.CropAnchor(img, b.Dx(), int(math.Max(1, cropHeight)+0.5), imaging.Center)
+		} else {
+			cropWidth := float64(b.Dy()) * float64(width) / float64(height)
+			cropped = imaging.CropAnchor(img, int(math.Max(1, cropWidth)+0.5), b.Dy(), imaging.Center)
+		}
+
+		return resizeBanded(ctx, cropped, width, height, filter)
+	}
+}
+
+// fitContext returns imaging.Fit stopping when the context is done.
+func fitContext(ctx context.Context) transformation {
+	return func(img image.Image, width int, height int, filter imaging.ResampleFilter) *image.NRGBA {
+		b := img.Bounds()
+		if width <= 0 || height <= 0 || (b.Dx() <= width && b.Dy() <= height) {
+			return imaging.Fit(img, width, height, filter)
+		}
+
+		// same dimensions as imaging.Fit
+		ratio := float64(b.Dx()) / float64(b.Dy())
+		if ratio > float64(width)/float64(height) {
+			height = int(float64(width) / ratio)
+		} else {
+			width = int(float64(height) * ratio)
+		}
+
+		return resizeBanded(ctx, img, width, height, filter)
+	}
+}
+
+// resizeBanded resizes the image like imaging.Resize, as both passes of
+// the resampling are separable the horizontal one is done by bands of
+// rows and the vertical one by bands of columns, the context is checked
+// between bands.
+func resizeBanded(ctx context.Context, img image.Image, width int, height int, filter imaging.ResampleFilter) *image.NRGBA {
+	b := img.Bounds()
+	if width < 0 || height < 0 || (width == 0 && height == 0) || b.Empty() || filter.Support <= 0 {
+		return imaging.Resize(img, width, height, filter)
+	}
+
+	if width == 0 {
+		width = int(math.Max(1.0, math.Floor(float64(height)*float64(b.Dx())/float64(b.Dy())+0.5)))
+	}
+	if height == 0 {
+		height = int(math.Max(1.0, math.Floor(float64(width)*float64(b.Dy())/float64(b.Dx())+0.5)))
+	}
+
+	if b.Dx() == width && b.Dy() == height {
+		return imaging.Clone(img)
+	}
+
+	src := img
+	if b.Dx() != width {
+		dst := image.NewNRGBA(image.Rect(0, 0, width, b.Dy()))
+		for y := 0; y < b.Dy() && ctx.Err() == nil; y += resizeBand {
+			band := image.Rect(b.Min.X, b.Min.Y+y, b.Max.X, b.Min.Y+min(y+resizeBand, b.Dy()))
+			resized := imaging.Resize(imaging.Crop(img, band), width, band.Dy(), filter)
+			draw.Draw(dst, resized.Bounds().Add(image.Pt(0, y)), resized, image.Point{}, draw.Src)
+		}
+
+		if b.Dy() == height {
+			return dst
+		}
+		src = dst
+	}
+
+	sb := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width && ctx.Err() == nil; x += resizeBand {
+		band := image.Rect(sb.Min.X+x, sb.Min.Y, sb.Min.X+min(x+resizeBand, width), sb.Max.Y)
+		resized := imaging.Resize(imaging.Crop(src, band), band.Dx(), height, filter)
+		draw.Draw(dst, resized.Bounds().Add(image.Pt(x, 0)), resized, image.Point{}, draw.Src)
+	}
+
+	return dst
+}
@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"context"
+	"image"
+	"io"
+	"math"
+
+	"github.com/go-spectest/imaging"
+
+	"github.com/thoas/picfit/constants"
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// anchoredTransformation is a transformation which keeps the anchor, given
+// as fractions of the image dimensions, in frame.
+type anchoredTransformation func(img image.Image, width int, height int, x float64, y float64, filter imaging.ResampleFilter) *image.NRGBA
+
+func (e *GoImage) Crop(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
+	return e.resize(ctx, dst, img, options, anchored(options, cropAt))
+}
+
+// anchored returns a transformation which keeps the anchor defined by the
+// options in frame, the anchor is resolved on the first image transformed
+// so every frame of an animated image is cropped the same way.
+func anchored(options *Options, trans anchoredTransformation) transformation {
+	var (
+		resolved bool
+		x, y     float64
+	)
+
+	return func(img image.Image, width int, height int, filter imaging.ResampleFilter) *image.NRGBA {
+		if !resolved {
+			x, y = anchor(img, options)
+			resolved = true
+		}
+
+		return trans(img, width, height, x, y, filter)
+	}
+}
+
+// hasAnchor returns true when the options define a point to keep in frame
+// other than the center.
+func hasAnchor(options *Options) bool {
+	return options.FocalPoint != nil || options.Gravity == constants.GravityFace
+}
+
+// anchor returns the point to keep in frame as fractions of the image dimensions,
+// the focal point takes precedence over detected faces.
+func anchor(img image.Image, options *Options) (float64, float64) {
+	if options.FocalPoint != nil {
+		return options.FocalPoint.X, options.FocalPoint.Y
+	}
+
+	if options.Gravity == constants.GravityFace {
+		faces := detectFaces(img)
+		if len(faces) > 0 {
+			r := faces[0]
+			for i := range faces[1:] {
+				r = r.Union(faces[i+1])
+			}
+
+			b := img.Bounds()
+			return (float64(r.Min.X+r.Max.X)/2 - float64(b.Min.X)) / float64(b.Dx()),
+				(float64(r.Min.Y+r.Max.Y)/2 - float64(b.Min.Y)) / float64(b.Dy())
+		}
+	}
+
+	return 0.5, 0.5
+}
+
+// fillAt crops the image to the aspect ratio of the given dimensions around
+// the anchor then resizes it to these dimensions.
+func fillAt(img image.Image, width int, height int, x float64, y float64, filter imaging.ResampleFilter) *image.NRGBA {
+	if width <= 0 || height <= 0 {
+		return imaging.Thumbnail(img, width, height, filter)
+	}
+
+	b := img.Bounds()
+	cropWidth, cropHeight := b.Dx(), b.Dy()
+	if float64(b.Dx())/float64(b.Dy()) > float64(width)/float64(height) {
+		cropWidth = max(1, int(math.Round(float64(b.Dy())*float64(width)/float64(height))))
+	} else {
+		cropHeight = max(1, int(math.Round(float64(b.Dx())*float64(height)/float64(width))))
+	}
+
+	return imaging.Resize(cropAt(img, cropWidth, cropHeight, x, y, filter), width, height, filter)
+}
+
+// cropAt crops the image to the given dimensions around the anchor,
+// the crop rectangle is kept inside the image.
+func cropAt(img image.Image, width int, height int, x float64, y float64, _ imaging.ResampleFilter) *image.NRGBA {
+	b := img.Bounds()
+	if width <= 0 || width > b.Dx() {
+		width = b.Dx()
+	}
+	if height <= 0 || height > b.Dy() {
+		height = b.Dy()
+	}
+
+	left := clamp(int(math.Round(x*float64(b.Dx())))-width/2, 0, b.Dx()-width)
+	top := clamp(int(math.Round(y*float64(b.Dy())))-height/2, 0, b.Dy()-height)
+
+	return imaging.Crop(img, image.Rect(left, top, left+width, top+height).Add(b.Min))
+}
+
+func clamp(value int, low int, high int) int {
+	return max(low, min(value, high))
+}
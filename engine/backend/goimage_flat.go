@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
-	"image/gif"
 	"io"
 	"strconv"
 	"strings"
@@ -28,12 +28,16 @@ func (e *GoImage) Flat(ctx context.Context, dst io.Writer, backgroundFile *image
 	}
 
 	if options.Format == imagefile.GIF {
-		g, err := gif.DecodeAll(backgroundFile.Stream)
+		g, err := decodeAll(backgroundFile.Stream)
 		if err != nil {
 			return err
 		}
 
 		for i := range g.Image {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			if options.Stick != "" {
 				drawStickForeground(g.Image[i], images, options)
 			} else {
@@ -41,7 +45,7 @@ func (e *GoImage) Flat(ctx context.Context, dst io.Writer, backgroundFile *image
 			}
 		}
 
-		if err := gif.EncodeAll(dst, g); err != nil {
+		if err := renderGIF(dst, g); err != nil {
 			return err
 		}
 
@@ -65,15 +69,16 @@ func (e *GoImage) Flat(ctx context.Context, dst io.Writer, backgroundFile *image
 		drawPosForeground(bg, images, options)
 	}
 
-	return encode(dst, bg, options.Format, options.Quality)
+	return render(ctx, dst, bg, options)
 }
 
 func drawStickForeground(bg draw.Image, images []image.Image, options *Options) {
 	for i := range images {
 		opts := &Options{
-			Upscale: true,
-			Width:   options.Width,
-			Height:  options.Height,
+			Upscale:  true,
+			Width:    options.Width,
+			Height:   options.Height,
+			Resample: options.Resample,
 		}
 
 		images[i] = scale(images[i], opts, imaging.Resize)
@@ -135,7 +140,7 @@ func foregroundImage(rec image.Rectangle, c string) draw.Image {
 		return fg
 	}
 
-	col, err := colorful.Hex(fmt.Sprintf("#%s", c))
+	col, err := ParseColor(c)
 	if err != nil {
 		return fg
 	}
@@ -144,6 +149,16 @@ func foregroundImage(rec image.Rectangle, c string) draw.Image {
 	return fg
 }
 
+// ParseColor parses a color in Hex (without #).
+func ParseColor(c string) (color.Color, error) {
+	col, err := colorful.Hex(fmt.Sprintf("#%s", c))
+	if err != nil {
+		return nil, err
+	}
+
+	return col, nil
+}
+
 // drawForeground draw the given images inside the destination foreground.
 // if the foreground image has a height superior to its width, the images
 // are vertically aligned, else they are horizontally aligned.
@@ -155,7 +170,7 @@ func drawForeground(fg draw.Image, images []image.Image, options *Options) draw.
 
 	// resize images for foreground
 	b := fg.Bounds()
-	opts := &Options{Upscale: true}
+	opts := &Options{Upscale: true, Resample: options.Resample}
 
 	if b.Dx() > b.Dy() {
 		opts.Width = b.Dx() / n
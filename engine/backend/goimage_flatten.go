@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+
+	"github.com/go-spectest/imaging"
+
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// Flatten composites the transparent pixels of the image onto the options
+// background color.
+func (e *GoImage) Flatten(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
+	bg, err := background(options)
+	if err != nil {
+		return err
+	}
+
+	trans := func(img image.Image) (image.Image, error) {
+		return flatten(img, bg), nil
+	}
+
+	if options.Format == imagefile.GIF {
+		return e.transformFrames(ctx, dst, img, trans)
+	}
+
+	image, err := e.source(img)
+	if err != nil {
+		return err
+	}
+
+	return render(ctx, dst, flatten(image, bg), options)
+}
+
+// background returns the options background color, white by default.
+func background(options *Options) (color.Color, error) {
+	if options.Background == "" {
+		return color.White, nil
+	}
+
+	return ParseColor(options.Background)
+}
+
+// hasAlpha returns true when the format can encode transparency.
+func hasAlpha(format imagefile.Format) bool {
+	return format != imagefile.JPEG
+}
+
+// flatten draws the image over the background color.
+func flatten(img image.Image, bg color.Color) *image.NRGBA {
+	b := img.Bounds()
+	dst := imaging.New(b.Dx(), b.Dy(), bg)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+
+	return dst
+}
+
+// opaque returns true when the image has no transparent pixel.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+
+	return false
+}
@@ -0,0 +1,269 @@
+package backend
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/go-spectest/imaging"
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/failure"
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// Liquid resizes the image to the given dimensions by removing the seams
+// with the lowest energy, the image is first scaled to cover the dimensions
+// so only the excess of one side is carved.
+func (e *GoImage) Liquid(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
+	cfg, err := e.sourceConfig(img)
+	if err != nil {
+		return err
+	}
+
+	// the options are shared with the next operations, a missing side keeps
+	// the source one for this operation only
+	opts := *options
+	if opts.Width == 0 {
+		opts.Width = cfg.Width
+	}
+	if opts.Height == 0 {
+		opts.Height = cfg.Height
+	}
+
+	width, height := coverSize(cfg.Width, cfg.Height, opts.Width, opts.Height)
+	if e.MaxLiquidPixels > 0 && width*height > e.MaxLiquidPixels {
+		return errors.Wrapf(failure.ErrFileMaxDimensions,
+			"liquid resize of %dx%d exceeds %d pixels", width, height, e.MaxLiquidPixels)
+	}
+
+	return e.resize(ctx, dst, img, &opts, carved(ctx))
+}
+
+// coverSize returns the smallest dimensions with the aspect ratio of the
+// source which cover the destination dimensions.
+func coverSize(srcWidth int, srcHeight int, dstWidth int, dstHeight int) (int, int) {
+	factor := scalingFactor(srcWidth, srcHeight, dstWidth, dstHeight)
+
+	return max(dstWidth, int(math.Round(float64(srcWidth)*factor))),
+		max(dstHeight, int(math.Round(float64(srcHeight)*factor)))
+}
+
+// carved returns a transformation which carves the image to the given dimensions,
+// the seams are found on the first image transformed so every frame of an
+// animated image is carved the same way. Carving stops when the context is done.
+func carved(ctx context.Context) transformation {
+	var vertical, horizontal [][]int
+
+	return func(img image.Image, width int, height int, filter imaging.ResampleFilter) *image.NRGBA {
+		b := img.Bounds()
+		coverWidth, coverHeight := coverSize(b.Dx(), b.Dy(), width, height)
+
+		c := newCarving(imaging.Resize(img, coverWidth, coverHeight, filter))
+
+		if vertical == nil {
+			vertical = c.seams(ctx, coverWidth-width)
+		} else {
+			c.remove(vertical)
+		}
+
+		c.transpose()
+		if horizontal == nil {
+			horizontal = c.seams(ctx, coverHeight-height)
+		} else {
+			c.remove(horizontal)
+		}
+		c.transpose()
+
+		return c.image()
+	}
+}
+
+// carving is an image being carved, pixels are stored row by row.
+// The luminance and the energy of the pixels are only kept while seams are
+// searched, they are updated along each removed seam.
+type carving struct {
+	width  int
+	height int
+	pix    []color.NRGBA
+	lum    []float64
+	energy []float64
+	cost   []float64
+}
+
+func newCarving(img *image.NRGBA) *carving {
+	b := img.Bounds()
+	c := &carving{
+		width:  b.Dx(),
+		height: b.Dy(),
+		pix:    make([]color.NRGBA, b.Dx()*b.Dy()),
+	}
+
+	for y := 0; y < c.height; y++ {
+		for x := 0; x < c.width; x++ {
+			c.pix[y*c.width+x] = img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+		}
+	}
+
+	return c
+}
+
+func (c *carving) image() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, c.width, c.height))
+	for y := 0; y < c.height; y++ {
+		for x := 0; x < c.width; x++ {
+			img.SetNRGBA(x, y, c.pix[y*c.width+x])
+		}
+	}
+
+	return img
+}
+
+// transpose swaps rows and columns so horizontal seams can be carved
+// as vertical ones.
+func (c *carving) transpose() {
+	pix := make([]color.NRGBA, len(c.pix))
+	for y := 0; y < c.height; y++ {
+		for x := 0; x < c.width; x++ {
+			pix[x*c.height+y] = c.pix[y*c.width+x]
+		}
+	}
+
+	c.pix, c.width, c.height = pix, c.height, c.width
+}
+
+// seams removes the given number of vertical seams with the lowest energy
+// and returns them.
+func (c *carving) seams(ctx context.Context, n int) [][]int {
+	if n <= 0 {
+		return nil
+	}
+
+	c.computeEnergy()
+	defer func() {
+		c.lum, c.energy, c.cost = nil, nil, nil
+	}()
+
+	seams := make([][]int, 0, n)
+	for i := 0; i < n && c.width > 1 && ctx.Err() == nil; i++ {
+		seam := c.seam()
+		c.removeSeam(seam)
+		c.updateEnergy(seam)
+		seams = append(seams, seam)
+	}
+
+	return seams
+}
+
+// remove removes the given vertical seams.
+func (c *carving) remove(seams [][]int) {
+	for _, seam := range seams {
+		if len(seam) != c.height || c.width <= 1 {
+			return
+		}
+		c.removeSeam(seam)
+	}
+}
+
+// seam returns the column of each row of the vertical seam with the
+// lowest cumulative energy.
+func (c *carving) seam() []int {
+	cost := c.cost[:len(c.energy)]
+
+	copy(cost, c.energy[:c.width])
+	for y := 1; y < c.height; y++ {
+		for x := 0; x < c.width; x++ {
+			i := y*c.width + x
+			up := cost[i-c.width]
+			if x > 0 {
+				up = min(up, cost[i-c.width-1])
+			}
+			if x < c.width-1 {
+				up = min(up, cost[i-c.width+1])
+			}
+			cost[i] = c.energy[i] + up
+		}
+	}
+
+	seam := make([]int, c.height)
+	last := (c.height - 1) * c.width
+	for x := 1; x < c.width; x++ {
+		if cost[last+x] < cost[last+seam[c.height-1]] {
+			seam[c.height-1] = x
+		}
+	}
+
+	for y := c.height - 2; y >= 0; y-- {
+		next := seam[y+1]
+		seam[y] = next
+		for _, x := range []int{next - 1, next + 1} {
+			if x >= 0 && x < c.width && cost[y*c.width+x] < cost[y*c.width+seam[y]] {
+				seam[y] = x
+			}
+		}
+	}
+
+	return seam
+}
+
+// computeEnergy computes the luminance and the energy of every pixel.
+func (c *carving) computeEnergy() {
+	c.lum = make([]float64, len(c.pix))
+	for i, p := range c.pix {
+		c.lum[i] = 0.299*float64(p.R) + 0.587*float64(p.G) + 0.114*float64(p.B)
+	}
+
+	c.energy = make([]float64, len(c.pix))
+	c.cost = make([]float64, len(c.pix))
+	for y := 0; y < c.height; y++ {
+		for x := 0; x < c.width; x++ {
+			c.energy[y*c.width+x] = c.energyAt(x, y)
+		}
+	}
+}
+
+// updateEnergy computes again the energy of the pixels whose neighbors
+// changed when the seam was removed: the two pixels on each side of the
+// seam, the seam moves by one column at most between two rows.
+func (c *carving) updateEnergy(seam []int) {
+	for y, x := range seam {
+		for i := max(x-1, 0); i <= min(x, c.width-1); i++ {
+			c.energy[y*c.width+i] = c.energyAt(i, y)
+		}
+	}
+}
+
+// energyAt returns the gradient magnitude of the luminance of a pixel.
+func (c *carving) energyAt(x int, y int) float64 {
+	left, right := max(x-1, 0), min(x+1, c.width-1)
+	top, bottom := max(y-1, 0), min(y+1, c.height-1)
+
+	return math.Abs(c.lum[y*c.width+right]-c.lum[y*c.width+left]) +
+		math.Abs(c.lum[bottom*c.width+x]-c.lum[top*c.width+x])
+}
+
+// removeSeam removes the pixels of the seam in place, with their luminance
+// and energy while seams are searched.
+func (c *carving) removeSeam(seam []int) {
+	c.pix = removeColumns(c.pix, c.width, seam)
+	if c.lum != nil {
+		c.lum = removeColumns(c.lum, c.width, seam)
+		c.energy = removeColumns(c.energy, c.width, seam)
+	}
+	c.width--
+}
+
+// removeColumns removes the column of each row of the seam, rows are moved
+// to the front of the slice.
+func removeColumns[T any](values []T, width int, seam []int) []T {
+	n := 0
+	for y, x := range seam {
+		row := values[y*width : (y+1)*width]
+		n += copy(values[n:], row[:x])
+		n += copy(values[n:], row[x+1:])
+	}
+
+	return values[:n]
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"strings"
+
+	"github.com/go-spectest/imaging"
+
+	"github.com/thoas/picfit/constants"
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// redactBlocks is the number of blocks along the largest side of a
+// pixelated region.
+const redactBlocks = 8
+
+func (e *GoImage) Redact(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, options *Options) error {
+	fill := color.Color(color.Black)
+	if options.Mode == constants.RedactFill && options.Color != "" {
+		col, err := ParseColor(options.Color)
+		if err != nil {
+			return err
+		}
+		fill = col
+	}
+
+	regions, err := redactRegions(options.Position)
+	if err != nil {
+		return err
+	}
+
+	trans := func(img image.Image) (image.Image, error) {
+		return redact(img, regions, options.Mode, fill), nil
+	}
+
+	if options.Format == imagefile.GIF {
+		return e.transformFrames(ctx, dst, img, trans)
+	}
+
+	image, err := e.source(img)
+	if err != nil {
+		return err
+	}
+
+	return render(ctx, dst, redact(image, regions, options.Mode, fill), options)
+}
+
+// transformFrames applies the transformation to every frame of a GIF,
+// frames are composited first so the transformation always receives
+// the full image.
+func (e *GoImage) transformFrames(ctx context.Context, dst io.Writer, img *imagefile.ImageFile, trans func(image.Image) (image.Image, error)) error {
+	g, err := decodeAll(img.Stream)
+	if err != nil {
+		return err
+	}
+
+	b := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if len(g.Image) > 0 && b.Empty() {
+		b = image.Rect(0, 0, g.Image[0].Bounds().Dx(), g.Image[0].Bounds().Dy())
+	}
+	im := image.NewRGBA(b)
+
+	for i, frame := range g.Image {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		draw.Draw(im, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		transformed, err := trans(im)
+		if err != nil {
+			return err
+		}
+		g.Image[i] = imageToPaletted(transformed)
+	}
+
+	if len(g.Image) > 0 {
+		g.Config.Width = g.Image[0].Bounds().Dx()
+		g.Config.Height = g.Image[0].Bounds().Dy()
+	}
+
+	return renderGIF(dst, g)
+}
+
+// redactRegions parses the regions delimited by the options position, regions
+// are separated by a comma and use the same format as Flat.
+func redactRegions(position string) ([]image.Rectangle, error) {
+	values := strings.Split(position, ",")
+	regions := make([]image.Rectangle, len(values))
+	for i := range values {
+		region, err := ParsePosition(values[i])
+		if err != nil {
+			return nil, err
+		}
+		regions[i] = region
+	}
+
+	return regions, nil
+}
+
+// redact masks every region of the image, regions are given in
+// percentages of the image dimensions.
+func redact(img image.Image, regions []image.Rectangle, mode string, fill color.Color) *image.NRGBA {
+	dst := imaging.Clone(img)
+	b := dst.Bounds()
+
+	for _, region := range regions {
+		r := image.Rectangle{
+			image.Point{b.Dx() * region.Min.X, b.Dy() * region.Min.Y}.Div(100),
+			image.Point{(b.Dx()*region.Max.X + 99) / 100, (b.Dy()*region.Max.Y + 99) / 100},
+		}.Add(b.Min).Intersect(b)
+		if r.Empty() {
+			continue
+		}
+
+		switch mode {
+		case constants.RedactFill:
+			draw.Draw(dst, r, &image.Uniform{fill}, image.Point{}, draw.Src)
+		case constants.RedactBlur:
+			sigma := float64(max(r.Dx(), r.Dy())) / 8
+			draw.Draw(dst, r, imaging.Blur(imaging.Crop(dst, r), sigma), image.Point{}, draw.Src)
+		default:
+			draw.Draw(dst, r, pixelate(imaging.Crop(dst, r)), image.Point{}, draw.Src)
+		}
+	}
+
+	return dst
+}
+
+// pixelate averages the image into large blocks.
+func pixelate(img *image.NRGBA) *image.NRGBA {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	block := max(1, (max(width, height)+redactBlocks-1)/redactBlocks)
+
+	small := imaging.Resize(img, max(1, width/block), max(1, height/block), imaging.Box)
+
+	return imaging.Resize(small, width, height, imaging.NearestNeighbor)
+}
@@ -0,0 +1,51 @@
+package backend
+
+import (
+	"context"
+	"image"
+
+	imagefile "github.com/thoas/picfit/image"
+)
+
+// Box is a rectangle in the coordinates of an image.
+type Box struct {
+	X0 int `json:"x0"`
+	Y0 int `json:"y0"`
+	X1 int `json:"x1"`
+	Y1 int `json:"y1"`
+}
+
+// Info holds the information retrieved from an image.
+type Info struct {
+	ContentType string      `json:"content_type"`
+	Faces       []Box       `json:"faces"`
+	FocalPoint  *FocalPoint `json:"focal_point,omitempty"`
+	Height      int         `json:"height"`
+	Width       int         `json:"width"`
+}
+
+// Inspect decodes an image and returns its dimensions and the faces found in it.
+func Inspect(ctx context.Context, img *imagefile.ImageFile) (*Info, error) {
+	src, err := decode(img.Stream)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		ContentType: img.ContentType(),
+		Faces:       []Box{},
+		Height:      src.Bounds().Dy(),
+		Width:       src.Bounds().Dx(),
+	}
+
+	for _, face := range detectFaces(src) {
+		face = face.Sub(src.Bounds().Min)
+		info.Faces = append(info.Faces, boxFromRectangle(face))
+	}
+
+	return info, nil
+}
+
+func boxFromRectangle(r image.Rectangle) Box {
+	return Box{X0: r.Min.X, Y0: r.Min.Y, X1: r.Max.X, Y1: r.Max.Y}
+}
@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"io"
+	"math"
+
+	"github.com/go-spectest/imaging"
+
+	imagefile "github.com/thoas/picfit/image"
+)
+
+const (
+	// minMaxBytesQuality is the lowest quality used to fit an image in MaxBytes.
+	minMaxBytesQuality = 10
+	// maxBytesScaleMargin keeps the downscaled image a bit below the estimated
+	// dimensions so the search converges quickly.
+	maxBytesScaleMargin = 0.9
+)
+
+// render encodes the image with the options, when MaxBytes is set the
+// quality is lowered, then the image downscaled, until the output fits.
+// The quality used is reported in the options.
+// Transparent images are flattened onto the options background for
+// formats without alpha, images rendered to a Buffer are kept decoded.
+func render(ctx context.Context, w io.Writer, img image.Image, options *Options) error {
+	if b, ok := w.(*Buffer); ok {
+		b.image, b.gif, b.options = img, nil, *options
+		return nil
+	}
+
+	if !hasAlpha(options.Format) && !opaque(img) {
+		bg, err := background(options)
+		if err != nil {
+			return err
+		}
+
+		img = flatten(img, bg)
+	}
+
+	if options.MaxBytes <= 0 || (options.Format != imagefile.JPEG && options.Format != imagefile.WEBP) {
+		return encode(w, img, options.Format, options.Quality)
+	}
+
+	buf, quality, err := encodeWithin(ctx, img, options)
+	if err != nil {
+		return err
+	}
+
+	options.Quality = quality
+
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// encodeWithin searches the highest quality for which the encoded image
+// fits in MaxBytes, the image is downscaled when even the lowest quality is too big.
+// The search stops as soon as the context is done.
+func encodeWithin(ctx context.Context, img image.Image, options *Options) (*bytes.Buffer, int, error) {
+	for {
+		buf, quality, fits, err := searchQuality(ctx, img, options)
+		if err != nil || fits {
+			return buf, quality, err
+		}
+
+		ratio := min(maxBytesScaleMargin, math.Sqrt(float64(options.MaxBytes)/float64(buf.Len()))*maxBytesScaleMargin)
+		width := int(float64(img.Bounds().Dx()) * ratio)
+		height := int(float64(img.Bounds().Dy()) * ratio)
+
+		// best effort, the image cannot be made smaller
+		if width < 1 || height < 1 {
+			return buf, quality, nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		img = imaging.Resize(img, width, height, resampleFilter(options))
+	}
+}
+
+// searchQuality binary searches the highest quality between minMaxBytesQuality
+// and the requested quality fitting in MaxBytes, the output at the lowest
+// quality is returned when none fits.
+func searchQuality(ctx context.Context, img image.Image, options *Options) (*bytes.Buffer, int, bool, error) {
+	encodeAt := func(quality int) (*bytes.Buffer, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		buf := &bytes.Buffer{}
+		if err := encode(buf, img, options.Format, quality); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	hi := max(options.Quality, minMaxBytesQuality)
+	best, err := encodeAt(hi)
+	if err != nil || best.Len() <= options.MaxBytes {
+		return best, hi, err == nil, err
+	}
+
+	lo := minMaxBytesQuality
+	lowest, err := encodeAt(lo)
+	if err != nil || lowest.Len() > options.MaxBytes {
+		return lowest, lo, false, err
+	}
+
+	best = lowest
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		buf, err := encodeAt(mid)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		if buf.Len() <= options.MaxBytes {
+			lo, best = mid, buf
+		} else {
+			hi = mid
+		}
+	}
+
+	return best, lo, true, nil
+}
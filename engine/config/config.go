@@ -23,6 +23,7 @@ type Config struct {
 	Format          string    `mapstructure:"format"`
 	Quality         int       `mapstructure:"quality"`
 	MaxBufferSize   int       `mapstructure:"max_buffer_size"`
+	MaxLiquidPixels int       `mapstructure:"max_liquid_pixels"`
 	ImageBufferSize int       `mapstructure:"image_buffer_size"`
 	JpegQuality     int       `mapstructure:"jpeg_quality"`
 	PngCompression  int       `mapstructure:"png_compression"`
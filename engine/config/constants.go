@@ -10,6 +10,9 @@ const (
 	// DefaultMaxBufferSize is the maximum size of buffer for lilliput
 	DefaultMaxBufferSize = 8192
 
+	// DefaultMaxLiquidPixels is the maximum number of pixels carved by a liquid resize
+	DefaultMaxLiquidPixels = 1000 * 1000
+
 	// DefaultImageBufferSize is the default image buffer size for lilliput
 	DefaultImageBufferSize = 50 * 1024 * 1024
 )
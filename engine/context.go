@@ -0,0 +1,36 @@
+package engine
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader is a reader failing once the context is done,
+// decoders reading the image by chunks stop at the next chunk.
+type contextReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.ReadCloser.Read(p)
+}
+
+// contextWriter is a writer failing once the context is done,
+// encoders writing the image by chunks stop at the next chunk.
+type contextWriter struct {
+	ctx context.Context
+	io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return w.Writer.Write(p)
+}
@@ -1,7 +1,6 @@
 package engine
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -37,9 +36,14 @@ type backendWrapper struct {
 func New(cfg config.Config, logger *slog.Logger) *Engine {
 	var b []*backendWrapper
 
+	maxLiquidPixels := config.DefaultMaxLiquidPixels
+	if cfg.MaxLiquidPixels != 0 {
+		maxLiquidPixels = cfg.MaxLiquidPixels
+	}
+
 	if cfg.Backends == nil {
 		b = append(b, &backendWrapper{
-			backend:   &backend.GoImage{},
+			backend:   &backend.GoImage{MaxLiquidPixels: maxLiquidPixels},
 			mimetypes: MimeTypes,
 		})
 	} else {
@@ -59,7 +63,7 @@ func New(cfg config.Config, logger *slog.Logger) *Engine {
 		}
 		if cfg.Backends.GoImage != nil {
 			b = append(b, &backendWrapper{
-				backend:   &backend.GoImage{},
+				backend:   &backend.GoImage{MaxLiquidPixels: maxLiquidPixels},
 				mimetypes: cfg.Backends.GoImage.Mimetypes,
 				weight:    cfg.Backends.GoImage.Weight,
 			})
@@ -102,18 +106,29 @@ func (e Engine) Transform(ctx context.Context, dst io.Writer, output *image.Imag
 
 	ct := output.ContentType()
 	for i := range operations {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+
 		isLast := i == len(operations)-1
 		var target io.Writer
 
 		// swith writer target
 		// on last operation we write on dst
-		// else we use a temp buffer
+		// else we use a temp buffer keeping the decoded image
 		if isLast {
-			target = dst
+			target = &contextWriter{ctx: ctx, Writer: dst}
 		} else {
-			target = &bytes.Buffer{}
+			target = &backend.Buffer{}
+		}
+
+		// decoded images are kept by buffers, encoded ones are read
+		// until the context is done
+		if _, ok := source.(*backend.Buffer); ok {
+			output.Stream = source
+		} else {
+			output.Stream = &contextReader{ctx: ctx, ReadCloser: source}
 		}
-		output.Stream = source
 
 		for j := range e.backends {
 			if !slices.Contains(e.backends[j].mimetypes, ct) {
@@ -135,14 +150,18 @@ func (e Engine) Transform(ctx context.Context, dst io.Writer, output *image.Imag
 				break
 			}
 
+			// decoders and encoders can hide the cancellation in their own errors
+			if ctx.Err() != nil {
+				return nil, errors.WithStack(ctx.Err())
+			}
+
 			if !errors.Is(err, backend.MethodNotImplementedError) {
 				return nil, err
 			}
 		}
 		// is not last operations so we repass target to new source stream
 		if !isLast {
-			buf := target.(*bytes.Buffer)
-			source = io.NopCloser(bytes.NewReader(buf.Bytes()))
+			source = target.(*backend.Buffer)
 		}
 	}
 
@@ -152,8 +171,7 @@ func (e Engine) Transform(ctx context.Context, dst io.Writer, output *image.Imag
 func operate(ctx context.Context, dst io.Writer, b backend.Backend, img *image.ImageFile, operation Operation, options *backend.Options) error {
 	switch operation {
 	case Noop:
-		_, err := io.Copy(dst, img.Stream)
-		return err
+		return backend.Copy(dst, img.Stream)
 	case Flip:
 		return b.Flip(ctx, dst, img, options)
 	case Rotate:
@@ -162,12 +180,26 @@ func operate(ctx context.Context, dst io.Writer, b backend.Backend, img *image.I
 		return b.Resize(ctx, dst, img, options)
 	case Thumbnail:
 		return b.Thumbnail(ctx, dst, img, options)
+	case Crop:
+		return b.Crop(ctx, dst, img, options)
 	case Fit:
 		return b.Fit(ctx, dst, img, options)
 	case Flat:
 		return b.Flat(ctx, dst, img, options)
 	case Effect:
 		return b.Effect(ctx, dst, img, options)
+	case Redact:
+		return b.Redact(ctx, dst, img, options)
+	case Border:
+		return b.Border(ctx, dst, img, options)
+	case Barcode:
+		return b.Barcode(ctx, dst, img, options)
+	case Liquid:
+		return b.Liquid(ctx, dst, img, options)
+	case Collage:
+		return b.Collage(ctx, dst, img, options)
+	case Flatten:
+		return b.Flatten(ctx, dst, img, options)
 	default:
 		return fmt.Errorf("operation not found for %s", operation)
 	}
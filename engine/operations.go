@@ -9,22 +9,36 @@ func (o Operation) String() string {
 }
 
 const (
+	Barcode   = Operation("barcode")
+	Border    = Operation("border")
+	Collage   = Operation("collage")
+	Crop      = Operation("crop")
 	Effect    = Operation("effect")
 	Fit       = Operation("fit")
 	Flat      = Operation("flat")
+	Flatten   = Operation("flatten")
 	Flip      = Operation("flip")
+	Liquid    = Operation("liquid")
 	Noop      = Operation("noop")
+	Redact    = Operation("redact")
 	Resize    = Operation("resize")
 	Rotate    = Operation("rotate")
 	Thumbnail = Operation("thumbnail")
 )
 
 var Operations = map[string]Operation{
+	Barcode.String():   Barcode,
+	Border.String():    Border,
+	Collage.String():   Collage,
+	Crop.String():      Crop,
 	Effect.String():    Effect,
 	Fit.String():       Fit,
 	Flat.String():      Flat,
+	Flatten.String():   Flatten,
 	Flip.String():      Flip,
+	Liquid.String():    Liquid,
 	Noop.String():      Noop,
+	Redact.String():    Redact,
 	Resize.String():    Resize,
 	Rotate.String():    Rotate,
 	Thumbnail.String(): Thumbnail,
@@ -3,6 +3,9 @@ package failure
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 )
 
 var (
@@ -21,6 +24,58 @@ var (
 	// ErrFileNotModified is an error when file is not modified
 	ErrFileNotModified = errors.New("File not modified")
 
+	// ErrSizeNotAllowed is an error when the requested size is not part of the allowed sizes
+	ErrSizeNotAllowed = errors.New("Requested size not allowed")
+
 	// ErrFileMaxDimensions is an error when file max dimensions is reached
 	ErrFileMaxDimensions = fmt.Errorf("Maximum of dimensions exceeded")
 )
+
+// OverloadedError is an error when too many images are being processed,
+// the request can be retried after RetryAfter
+type OverloadedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OverloadedError) Error() string {
+	return "Too many images being processed"
+}
+
+const (
+	// SourceNotFound is the type of failure of a source which does not exist
+	SourceNotFound = "not_found"
+	// SourceUnavailable is the type of failure of a source answering with an error status
+	SourceUnavailable = "unavailable"
+	// SourceUndecodable is the type of failure of a source which is not an image
+	SourceUndecodable = "undecodable"
+)
+
+// SourceError is an error when a source image can not be retrieved or
+// decoded, StatusCode is the status answered by the source, if any
+type SourceError struct {
+	Type       string `json:"type"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Err        error  `json:"-"`
+}
+
+func (e *SourceError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("Source image %s", strings.ReplaceAll(e.Type, "_", " "))
+	}
+	return e.Err.Error()
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the status answered for the failure
+func (e *SourceError) Status() int {
+	switch e.Type {
+	case SourceNotFound:
+		return http.StatusNotFound
+	case SourceUndecodable:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadGateway
+}
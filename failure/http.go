@@ -1,7 +1,10 @@
 package failure
 
 import (
+	"context"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/mholt/binding"
@@ -24,10 +27,30 @@ func Handle(h Handler) gin.HandlerFunc {
 				c.AbortWithStatus(http.StatusNotModified)
 				return
 			}
+			if cerr == ErrSizeNotAllowed {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
 			if cerr == ErrFileMaxDimensions {
 				c.AbortWithStatus(http.StatusUnprocessableEntity)
 				return
 			}
+			var serr *SourceError
+			if errors.As(err, &serr) {
+				c.AbortWithStatus(serr.Status())
+				return
+			}
+
+			var oerr *OverloadedError
+			if errors.As(err, &oerr) {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(oerr.RetryAfter.Seconds()))))
+				c.AbortWithStatus(http.StatusServiceUnavailable)
+				return
+			}
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				c.AbortWithStatus(http.StatusGatewayTimeout)
+				return
+			}
 
 			switch cerr.(type) {
 			case binding.Errors:
@@ -0,0 +1,182 @@
+package picfit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/cstockton/go-conv"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/image"
+	"github.com/thoas/picfit/store"
+)
+
+// lockPollInterval is the interval at which an instance waiting for the
+// lock of another instance checks the store.
+const lockPollInterval = 100 * time.Millisecond
+
+// flightIOTimeout is the time given to fetch and store an image processed
+// once for concurrent requests, on top of the waits and the transformation.
+const flightIOTimeout = 30 * time.Second
+
+// flight is the result of an image processed once for concurrent requests.
+type flight struct {
+	file *image.ImageFile
+	data []byte
+}
+
+// image returns a copy of the processed image for a request.
+func (f *flight) image() *image.ImageFile {
+	file := *f.file
+	file.Headers = make(map[string]string, len(f.file.Headers))
+	for k, v := range f.file.Headers {
+		file.Headers[k] = v
+	}
+	if f.data != nil {
+		file.HTTPStream = io.NopCloser(bytes.NewReader(f.data))
+	}
+
+	return &file
+}
+
+// processImageOnce processes the image of the store key once for concurrent
+// identical requests, waiters share the result of the first request.
+//
+// The image is processed on its own goroutine with a copy of the request
+// which outlives it, so waiters are not failed when the first request goes away.
+func (p *Processor) processImageOnce(c *gin.Context, storeKey string, options Options) (*image.ImageFile, error) {
+	var (
+		ctx = c.Request.Context()
+		cc  = c.Copy()
+	)
+
+	ch := p.flights.DoChan(flightKey(storeKey, options), func() (any, error) {
+		flightctx, cancel := p.detachContext(cc.Request.Context())
+		defer cancel()
+		cc.Request = cc.Request.WithContext(flightctx)
+
+		file, err := p.processImageLocked(cc, storeKey, options)
+		if err != nil {
+			return nil, err
+		}
+
+		result := &flight{file: file}
+		if file.HTTPStream != nil {
+			if result.data, err = io.ReadAll(file.HTTPStream); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+
+		return result, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, errors.WithStack(ctx.Err())
+	case res := <-ch:
+		if res.Err != nil {
+			// the first request went away, the image is processed again
+			if res.Shared && ctx.Err() == nil &&
+				(errors.Is(res.Err, context.Canceled) || errors.Is(res.Err, context.DeadlineExceeded)) {
+				return p.processImage(c, storeKey, options)
+			}
+
+			return nil, res.Err
+		}
+
+		if res.Shared {
+			p.Logger.InfoContext(ctx, "Image processed by a concurrent request",
+				slog.String("key", storeKey))
+		}
+
+		return res.Val.(*flight).image(), nil
+	}
+}
+
+// flightKey returns the key of the flight processing the image of the
+// store key, requests share a flight only with the same options: the image
+// is loaded, stored before returning and scheduled differently otherwise.
+func flightKey(storeKey string, options Options) string {
+	return fmt.Sprintf("%s:%t:%t:%s", storeKey, options.Load, options.Async, options.Priority)
+}
+
+// detachContext returns a context which is not canceled with the request,
+// bounded by the time to wait for the lock and the semaphore, transform
+// the image, fetch and store it.
+func (p *Processor) detachContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(p.config.Options.LockTimeout+p.config.Options.MaxProcessorWait+
+		p.config.Options.TransformTimeout)*time.Second + flightIOTimeout
+
+	return context.WithTimeout(context.WithoutCancel(ctx), timeout)
+}
+
+// processImageLocked processes the image of the store key once for a
+// cluster: instances waiting for the lock retrieve the image stored by
+// the instance holding it, the lock is released once the image is stored.
+func (p *Processor) processImageLocked(c *gin.Context, storeKey string, options Options) (*image.ImageFile, error) {
+	timeout := time.Duration(p.config.Options.LockTimeout) * time.Second
+	if timeout <= 0 {
+		return p.processImage(c, storeKey, options)
+	}
+
+	var (
+		ctx     = c.Request.Context()
+		lockKey = fmt.Sprintf("%s:lock", storeKey)
+		force   = c.Query("force") != ""
+		log     = p.Logger.With(slog.String("key", storeKey))
+	)
+
+	for {
+		// the lock expires after the timeout when its instance is gone
+		release, acquired, err := store.Lock(ctx, p.store, lockKey, timeout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if acquired {
+			// the lock is held until the image is stored, queued images
+			// are stored after the request
+			options.stored = release
+
+			return p.processImage(c, storeKey, options)
+		}
+
+		log.InfoContext(ctx, "Image processed by another instance, waiting...")
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+
+		// a forced image is stored again by the other instance
+		if force {
+			continue
+		}
+
+		filepathRaw, err := p.store.Get(ctx, storeKey)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if filepathRaw != nil {
+			filepath, err := conv.String(filepathRaw)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			img, err := p.fileFromStorage(ctx, storeKey, filepath, options.Load)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			img.HTTPStream = img.Stream
+
+			return img, nil
+		}
+	}
+}
@@ -31,7 +31,9 @@ require (
 )
 
 require (
+	github.com/boombuler/barcode v1.1.0
 	github.com/chai2010/webp v1.4.0
+	github.com/esimov/pigo v1.4.6
 	github.com/google/uuid v1.3.0
 	github.com/prometheus/client_golang v1.14.0
 	golang.org/x/sync v0.20.0
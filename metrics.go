@@ -7,7 +7,17 @@ import (
 var defaultMetrics = newMetrics()
 
 type metrics struct {
-	histogram *prometheus.HistogramVec
+	histogram     *prometheus.HistogramVec
+	storeQueue    prometheus.Gauge
+	storeRetries  prometheus.Counter
+	storeFailures prometheus.Counter
+
+	semaphoreQueue *prometheus.GaugeVec
+	semaphoreWait  *prometheus.HistogramVec
+	semaphoreShed  *prometheus.CounterVec
+
+	renderCache     *prometheus.CounterVec
+	renderCacheSize prometheus.Gauge
 }
 
 func newMetrics() *metrics {
@@ -16,9 +26,51 @@ func newMetrics() *metrics {
 			prometheus.HistogramOpts{Name: "picfit_action_seconds"},
 			[]string{"picfit_method", "picfit_image_type"},
 		),
+		storeQueue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "picfit_store_queue_length",
+			Help: "Number of images waiting to be stored in the background",
+		}),
+		storeRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "picfit_store_retries_total",
+			Help: "Number of retries of background storages",
+		}),
+		storeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "picfit_store_failures_total",
+			Help: "Number of images not stored in the background after all retries",
+		}),
+		semaphoreQueue: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "picfit_processor_queue_length",
+			Help: "Number of requests waiting for transformation slots",
+		}, []string{"priority"}),
+		semaphoreWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "picfit_processor_wait_seconds",
+			Help: "Time waited by requests for transformation slots",
+		}, []string{"priority"}),
+		semaphoreShed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "picfit_processor_shed_total",
+			Help: "Number of requests rejected because of too many waiting requests or a too long wait",
+		}, []string{"reason", "priority"}),
+		renderCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "picfit_render_cache_total",
+			Help: "Number of lookups of rendered images in the memory cache",
+		}, []string{"result"}),
+		renderCacheSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "picfit_render_cache_bytes",
+			Help: "Size of the rendered images in the memory cache",
+		}),
 	}
 }
 
 func init() {
-	prometheus.MustRegister(defaultMetrics.histogram)
+	prometheus.MustRegister(
+		defaultMetrics.histogram,
+		defaultMetrics.storeQueue,
+		defaultMetrics.storeRetries,
+		defaultMetrics.storeFailures,
+		defaultMetrics.semaphoreQueue,
+		defaultMetrics.semaphoreWait,
+		defaultMetrics.semaphoreShed,
+		defaultMetrics.renderCache,
+		defaultMetrics.renderCacheSize,
+	)
 }
@@ -45,6 +45,17 @@ func RestrictSizes(sizes []config.AllowedSize) gin.HandlerFunc {
 	handler := func(c *gin.Context, sizes []config.AllowedSize) {
 		params := c.MustGet("parameters").(map[string]any)
 
+		// derived sizes are resolved and restricted by the processor
+		if _, ok := c.Get("hints"); ok {
+			return
+		}
+
+		for _, name := range []string{"dpr", "max-w", "max-h"} {
+			if _, ok := params[name]; ok {
+				return
+			}
+		}
+
 		var w int
 		var h int
 		var err error
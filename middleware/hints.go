@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	dprHeader           = "Sec-CH-DPR"
+	widthHeader         = "Sec-CH-Width"
+	viewportWidthHeader = "Sec-CH-Viewport-Width"
+
+	minHintDPR = 1
+	maxHintDPR = 4
+)
+
+var clientHintsHeaders = strings.Join([]string{dprHeader, widthHeader, viewportWidthHeader}, ", ")
+
+// ClientHints resolves the size parameters from the client hints request
+// headers when they are not explicitly provided and adds them to the context.
+func ClientHints(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !enabled {
+			c.Next()
+			return
+		}
+
+		c.Header("Accept-CH", clientHintsHeaders)
+		c.Writer.Header().Add("Vary", clientHintsHeaders)
+
+		explicit := func(name string) bool {
+			if params, ok := c.Get("parameters"); ok {
+				if _, ok := params.(map[string]any)[name]; ok {
+					return true
+				}
+			}
+
+			_, ok := c.GetQuery(name)
+			return ok
+		}
+
+		if hints := clientHints(c.Request.Header, explicit); len(hints) > 0 {
+			c.Set("hints", hints)
+		}
+
+		c.Next()
+	}
+}
+
+// clientHints maps the client hints headers to size parameters:
+// the width, in physical pixels, is used when no size is requested,
+// otherwise the device pixel ratio multiplies the requested size.
+// The viewport width bounds the width of the image.
+func clientHints(header http.Header, explicit func(string) bool) map[string]any {
+	var (
+		hints = make(map[string]any)
+		dpr   = 1.0
+	)
+
+	if value, err := strconv.ParseFloat(header.Get(dprHeader), 64); err == nil {
+		dpr = min(max(value, minHintDPR), maxHintDPR)
+	}
+
+	width, _ := strconv.Atoi(header.Get(widthHeader))
+	viewportWidth, _ := strconv.Atoi(header.Get(viewportWidthHeader))
+
+	if width > 0 && !explicit("w") && !explicit("h") && !explicit("dpr") {
+		hints["w"] = strconv.Itoa(width)
+
+		// the viewport width is in CSS pixels
+		if viewportWidth > 0 && !explicit("max-w") {
+			hints["max-w"] = strconv.Itoa(int(math.Round(float64(viewportWidth) * dpr)))
+		}
+
+		return hints
+	}
+
+	if dpr != 1 && !explicit("dpr") {
+		hints["dpr"] = strconv.FormatFloat(dpr, 'f', -1, 64)
+	}
+
+	if viewportWidth > 0 && !explicit("max-w") {
+		hints["max-w"] = strconv.Itoa(viewportWidth)
+	}
+
+	return hints
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientHints(t *testing.T) {
+	header := http.Header{}
+	header.Set("Sec-CH-DPR", "2")
+	header.Set("Sec-CH-Width", "640")
+	header.Set("Sec-CH-Viewport-Width", "400")
+
+	none := func(string) bool { return false }
+
+	hints := clientHints(header, none)
+	assert.Equal(t, map[string]any{"w": "640", "max-w": "800"}, hints)
+
+	hints = clientHints(header, func(name string) bool { return name == "w" })
+	assert.Equal(t, map[string]any{"dpr": "2", "max-w": "400"}, hints)
+
+	hints = clientHints(header, func(name string) bool { return name == "w" || name == "dpr" || name == "max-w" })
+	assert.Empty(t, hints)
+
+	header = http.Header{}
+	header.Set("Sec-CH-DPR", "8")
+	assert.Equal(t, map[string]any{"dpr": "4"}, clientHints(header, none))
+
+	assert.Empty(t, clientHints(http.Header{}, none))
+}
@@ -67,6 +67,11 @@ func KeyParser() gin.HandlerFunc {
 		delete(sorted, constants.ForceParamName)
 
 		if len(sorted) != 0 {
+			// client hints are part of the key but not of the signed parameters
+			if hints, ok := c.Get("hints"); ok {
+				sorted = withHints(sorted, hints.(map[string]any))
+			}
+
 			serialized := hash.Serialize(sorted)
 
 			key := hash.Tokey(serialized)
@@ -79,6 +84,18 @@ func KeyParser() gin.HandlerFunc {
 	}
 }
 
+func withHints(params map[string]any, hints map[string]any) map[string]any {
+	results := make(map[string]any, len(params)+len(hints))
+	for k, v := range params {
+		results[k] = v
+	}
+	for k, v := range hints {
+		results[fmt.Sprintf("%s:%s", constants.HintsParamName, k)] = v
+	}
+
+	return util.SortMapString(results)
+}
+
 func setParamsFromURLValues(params map[string]any, values url.Values) map[string]any {
 	for k, v := range values {
 		if k != constants.OperationParamName {
@@ -108,7 +125,8 @@ func URLParser(mimetypeDetectorType string, processor *picfit.Processor) gin.Han
 	mimetypeDetector := image.GetMimetypeDetector(mimetypeDetectorType)
 
 	return func(c *gin.Context) {
-		if storeKey := c.MustGet("key").(string); storeKey != "" {
+		// forced images are processed again from their url
+		if storeKey := c.MustGet("key").(string); storeKey != "" && c.Query(constants.ForceParamName) == "" {
 			exists, err := processor.KeyExists(c.Request.Context(), storeKey)
 			if err != nil {
 				c.Abort()
@@ -173,7 +191,7 @@ func OperationParser() gin.HandlerFunc {
 			if !ok {
 				params := make(map[string]string)
 				for _, p := range strings.Split(operations[i], " ") {
-					l := strings.Split(p, ":")
+					l := strings.SplitN(p, ":", 2)
 					if len(l) > 1 {
 						params[l[0]] = l[1]
 					}
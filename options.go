@@ -5,8 +5,30 @@ type Option func(*Options)
 
 // Options are server options.
 type Options struct {
-	Load  bool
-	Async bool
+	Load     bool
+	Async    bool
+	Priority Priority
+
+	// stored is called once the processed image is stored, or failed
+	stored func()
+}
+
+// Priority is the scheduling priority of the transformations of a request.
+type Priority int
+
+const (
+	// PriorityInteractive is the priority of requests waited for by users
+	PriorityInteractive Priority = iota
+	// PriorityBackground is the priority of pre-generation requests, they
+	// wait for interactive requests to get slots
+	PriorityBackground
+)
+
+func (p Priority) String() string {
+	if p == PriorityBackground {
+		return "background"
+	}
+	return "interactive"
 }
 
 // NewOptions initializes server options.
@@ -31,3 +53,10 @@ func WithAsync(async bool) Option {
 		o.Async = async
 	}
 }
+
+// WithPriority overrides priority value.
+func WithPriority(priority Priority) Option {
+	return func(o *Options) {
+		o.Priority = priority
+	}
+}
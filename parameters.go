@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/mholt/binding"
 	"github.com/pkg/errors"
 	"github.com/ulule/gostorages"
 
@@ -19,9 +20,10 @@ import (
 
 const (
 	defaultDegree  = 90
-	defaultHeight  = 0
 	defaultUpscale = true
-	defaultWidth   = 0
+
+	// maxBorderSize is the maximum width in pixels of a border side or a shadow.
+	maxBorderSize = 1000
 )
 
 var formats = map[string]image.Format{
@@ -34,6 +36,14 @@ var formats = map[string]image.Format{
 	"webp": image.WEBP,
 }
 
+// operationModes are the values accepted by the "mode" parameter for each operation.
+var operationModes = map[engine.Operation][]string{
+	engine.Barcode: constants.BarcodeModes,
+	engine.Collage: constants.CollageModes,
+	engine.Effect:  constants.EnhanceModes,
+	engine.Redact:  constants.RedactModes,
+}
+
 type Parameters struct {
 	output     *image.ImageFile
 	operations []engine.EngineOperation
@@ -80,12 +90,15 @@ func (p *Processor) NewParameters(ctx context.Context, input *image.ImageFile, q
 		Filepath: filepath,
 	}
 
-	var operations []engine.EngineOperation
+	var (
+		operations []engine.EngineOperation
+		source     = newSourceSize(output)
+	)
 
 	op, ok := qs["op"].(string)
 	if ok {
 		operation := engine.Operation(op)
-		opts, err := p.newBackendOptionsFromParameters(operation, qs)
+		opts, err := p.newBackendOptionsFromParameters(operation, qs, source)
 		if err != nil {
 			return nil, err
 		}
@@ -105,12 +118,12 @@ func (p *Processor) NewParameters(ctx context.Context, input *image.ImageFile, q
 			operation, k := engine.Operations[ops[i]]
 			if k {
 				engineOperation.Operation = operation
-				engineOperation.Options, err = p.newBackendOptionsFromParameters(operation, qs)
+				engineOperation.Options, err = p.newBackendOptionsFromParameters(operation, qs, source)
 				if err != nil {
 					return nil, err
 				}
 			} else {
-				engineOperation, err = p.NewEngineOperationFromQuery(ctx, ops[i])
+				engineOperation, err = p.newEngineOperationFromQuery(ctx, ops[i], source)
 				if err != nil {
 					return nil, err
 				}
@@ -123,17 +136,40 @@ func (p *Processor) NewParameters(ctx context.Context, input *image.ImageFile, q
 		}
 	}
 
+	// the byte budget only applies to the final encoding of formats with a quality
+	if value, ok := qs["maxbytes"].(string); ok && len(operations) > 0 {
+		maxBytes, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if maxBytes <= 0 {
+			return nil, fmt.Errorf("parameter \"maxbytes\" should be positive")
+		}
+
+		if f := formats[format]; f == image.JPEG || f == image.WEBP {
+			operations[len(operations)-1].Options.MaxBytes = maxBytes
+		}
+	}
+
 	return &Parameters{
 		output:     output,
 		operations: operations,
 	}, nil
 }
 
+// NewEngineOperationFromQuery returns the operation defined by the "op:name key:value" syntax,
+// sizes relative to the source image are not supported.
 func (p Processor) NewEngineOperationFromQuery(ctx context.Context, op string) (*engine.EngineOperation, error) {
+	return p.newEngineOperationFromQuery(ctx, op, nil)
+}
+
+func (p Processor) newEngineOperationFromQuery(ctx context.Context, op string, source sourceSize) (*engine.EngineOperation, error) {
 	params := make(map[string]any)
 	var imagePaths []string
 	for _, p := range strings.Split(op, " ") {
-		l := strings.Split(p, ":")
+		// values such as urls can contain colons
+		l := strings.SplitN(p, ":", 2)
 		if len(l) > 1 {
 			if l[0] == "path" {
 				imagePaths = append(imagePaths, l[1])
@@ -149,7 +185,7 @@ func (p Processor) NewEngineOperationFromQuery(ctx context.Context, op string) (
 	}
 
 	operation := engine.Operation(op)
-	opts, err := p.newBackendOptionsFromParameters(operation, params)
+	opts, err := p.newBackendOptionsFromParameters(operation, params, source)
 	if err != nil {
 		return nil, err
 	}
@@ -172,13 +208,11 @@ func (p Processor) NewEngineOperationFromQuery(ctx context.Context, op string) (
 	}, nil
 }
 
-func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, qs map[string]any) (*backend.Options, error) {
+func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, qs map[string]any, source sourceSize) (*backend.Options, error) {
 	var (
 		err     error
 		quality = p.engine.DefaultQuality
 		upscale = defaultUpscale
-		height  = defaultHeight
-		width   = defaultWidth
 		degree  = defaultDegree
 	)
 
@@ -195,10 +229,19 @@ func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, q
 	}
 
 	position, ok := qs["pos"].(string)
-	if !ok && operation == engine.Flip {
+	if !ok && (operation == engine.Flip || operation == engine.Redact) {
 		return nil, fmt.Errorf("Parameter \"pos\" not found in query string")
 	}
 
+	// every region of a redaction must be masked, a malformed one is not skipped
+	if operation == engine.Redact {
+		for _, region := range strings.Split(position, ",") {
+			if _, err := backend.ParsePosition(region); err != nil {
+				return nil, binding.Errors{binding.NewError([]string{"pos"}, binding.TypeError, err.Error())}
+			}
+		}
+	}
+
 	stick, ok := qs["stick"].(string)
 	if ok {
 		if !slices.Contains(constants.StickPositions, stick) {
@@ -208,6 +251,13 @@ func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, q
 
 	color, _ := qs["color"].(string)
 
+	bg, _ := qs["bg"].(string)
+
+	text, _ := qs["text"].(string)
+	if text == "" && operation == engine.Barcode {
+		return nil, binding.Errors{binding.NewError([]string{"text"}, binding.RequiredError, "parameter \"text\" is required")}
+	}
+
 	if deg, ok := qs["deg"].(string); ok {
 		degree, err = strconv.Atoi(deg)
 		if err != nil {
@@ -222,34 +272,223 @@ func (p Processor) newBackendOptionsFromParameters(operation engine.Operation, q
 		}
 	}
 
-	if w, ok := qs["w"].(string); ok {
-		width, err = strconv.Atoi(w)
+	width, height, derived, err := resolveSize(qs, source)
+	if err != nil {
+		return nil, err
+	}
+
+	// plain sizes are restricted by the RestrictSizes middleware
+	if derived && (width != 0 || height != 0) {
+		if err := p.checkAllowedSize(width, height); err != nil {
+			return nil, err
+		}
+	}
+
+	filter, ok := qs["filter"].(string)
+	if ok && !slices.Contains(constants.Filters, filter) {
+		return nil, fmt.Errorf("parameter \"filter\" has wrong value. Available values are: %v", constants.Filters)
+	}
+
+	if slices.Contains(constants.ColorFilters, filter) && color == "" {
+		return nil, fmt.Errorf("parameter \"color\" is required by the %s filter", filter)
+	}
+
+	var strength int
+	if value, ok := qs["strength"].(string); ok {
+		strength, err = strconv.Atoi(value)
 		if err != nil {
 			return nil, err
 		}
+
+		if strength < 1 || strength > 100 {
+			return nil, fmt.Errorf("parameter \"strength\" should be between 1 and 100")
+		}
 	}
 
-	if h, ok := qs["h"].(string); ok {
-		height, err = strconv.Atoi(h)
+	resample, ok := qs["resample"].(string)
+	if ok && !slices.Contains(constants.ResampleFilters, resample) {
+		return nil, fmt.Errorf("parameter \"resample\" has wrong value. Available values are: %v", constants.ResampleFilters)
+	}
+
+	var focalPoint *backend.FocalPoint
+	if fp, ok := qs["fp"].(string); ok {
+		focalPoint, err = backend.ParseFocalPoint(fp)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	filter, ok := qs["filter"].(string)
-	if ok && !slices.Contains(constants.Filters, filter) {
-		return nil, fmt.Errorf("parameter \"filter\" has wrong value. Available values are: %v", constants.Filters)
+	mode, ok := qs["mode"].(string)
+	if modes, exists := operationModes[operation]; ok && exists {
+		// collage cells can each have their own mode
+		values := []string{mode}
+		if operation == engine.Collage {
+			values = strings.Split(mode, ".")
+		}
+
+		for i := range values {
+			if !slices.Contains(modes, values[i]) {
+				return nil, fmt.Errorf("parameter \"mode\" has wrong value. Available values are: %v", modes)
+			}
+		}
+	}
+
+	var layout []int
+	if value, ok := qs["layout"].(string); ok {
+		layout, err = backend.ParseLayout(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var gutter int
+	if value, ok := qs["gutter"].(string); ok {
+		gutter, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if gutter < 0 {
+			return nil, fmt.Errorf("parameter \"gutter\" should not be negative")
+		}
+	}
+
+	var border *backend.Border
+	if size, ok := qs["size"].(string); ok {
+		border, err = backend.ParseBorder(size)
+		if err != nil {
+			return nil, err
+		}
+
+		if max(border.Top, border.Right, border.Bottom, border.Left) > maxBorderSize {
+			return nil, fmt.Errorf("parameter \"size\" should not exceed %d", maxBorderSize)
+		}
+	} else if operation == engine.Border {
+		return nil, fmt.Errorf("Parameter \"size\" not found in query string")
+	}
+
+	var shadow int
+	if value, ok := qs["shadow"].(string); ok {
+		shadow, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if shadow < 0 || shadow > maxBorderSize {
+			return nil, fmt.Errorf("parameter \"shadow\" should be between 0 and %d", maxBorderSize)
+		}
+	}
+
+	gravity, ok := qs["gravity"].(string)
+	if ok && !slices.Contains(constants.Gravities, gravity) {
+		return nil, fmt.Errorf("parameter \"gravity\" has wrong value. Available values are: %v", constants.Gravities)
+	}
+
+	// colors are parsed when rendering, malformed ones are rejected first
+	if bg != "" {
+		if err := checkColor("bg", bg); err != nil {
+			return nil, err
+		}
+	}
+
+	if operation == engine.Border && color != "" {
+		if err := checkColor("color", color); err != nil {
+			return nil, err
+		}
+	}
+
+	if operation == engine.Redact && mode == constants.RedactFill && color != "" {
+		if err := checkColor("color", color); err != nil {
+			return nil, err
+		}
+	}
+
+	// color filters take a comma separated list of colors
+	if slices.Contains(constants.ColorFilters, filter) {
+		for _, value := range strings.Split(color, ",") {
+			if err := checkColor("color", value); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return &backend.Options{
-		Color:    color,
-		Degree:   degree,
-		Filter:   filter,
-		Height:   height,
-		Position: position,
-		Quality:  quality,
-		Stick:    stick,
-		Upscale:  upscale,
-		Width:    width,
+		Background: bg,
+		Border:     border,
+		Color:      color,
+		Degree:     degree,
+		Filter:     filter,
+		FocalPoint: focalPoint,
+		Gravity:    gravity,
+		Gutter:     gutter,
+		Height:     height,
+		Layout:     layout,
+		Mode:       mode,
+		Position:   position,
+		Quality:    quality,
+		Resample:   resample,
+		Shadow:     shadow,
+		Stick:      stick,
+		Strength:   strength,
+		Text:       text,
+		Upscale:    upscale,
+		Width:      width,
+	}, nil
+}
+
+// checkColor returns an error when the parameter is not a color in Hex.
+func checkColor(name string, value string) error {
+	if _, err := backend.ParseColor(value); err != nil {
+		return binding.Errors{binding.NewError([]string{name}, binding.TypeError,
+			fmt.Sprintf("parameter %q should be a color in Hex (without #)", name))}
+	}
+
+	return nil
+}
+
+// NewCompareOptions returns the options to compare two images.
+func (p Processor) NewCompareOptions(qs map[string]any) (*backend.CompareOptions, error) {
+	var (
+		err       error
+		format    = image.PNG
+		quality   = p.engine.DefaultQuality
+		threshold int
+	)
+
+	if f, ok := qs["fmt"].(string); ok {
+		if format, ok = formats[f]; !ok {
+			return nil, fmt.Errorf("Unknown format %s", f)
+		}
+	}
+
+	if q, ok := qs["q"].(string); ok {
+		quality, err = strconv.Atoi(q)
+		if err != nil {
+			return nil, err
+		}
+
+		if quality > 100 {
+			return nil, failure.ErrQuality
+		}
+	}
+
+	if t, ok := qs["threshold"].(string); ok {
+		threshold, err = strconv.Atoi(t)
+		if err != nil {
+			return nil, err
+		}
+
+		if threshold < 0 || threshold > 255 {
+			return nil, fmt.Errorf("parameter \"threshold\" should be between 0 and 255")
+		}
+	}
+
+	color, _ := qs["color"].(string)
+
+	return &backend.CompareOptions{
+		Color:     color,
+		Format:    format,
+		Quality:   quality,
+		Threshold: threshold,
 	}, nil
 }
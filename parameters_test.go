@@ -21,3 +21,14 @@ func TestEngineOperationFromQuery(t *testing.T) {
 	assert.Equal(t, operation.Options.Quality, 99)
 	assert.True(t, operation.Options.Upscale)
 }
+
+func TestEngineOperationFromQueryResample(t *testing.T) {
+	processor := tests.NewDummyProcessor(context.Background())
+
+	operation, err := processor.NewEngineOperationFromQuery(context.Background(), "op:resize w:100 resample:nearest")
+	assert.Nil(t, err)
+	assert.Equal(t, "nearest", operation.Options.Resample)
+
+	_, err = processor.NewEngineOperationFromQuery(context.Background(), "op:resize w:100 resample:bicubic")
+	assert.NotNil(t, err)
+}
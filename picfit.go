@@ -3,6 +3,11 @@ package picfit
 import (
 	"context"
 	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/thoas/picfit/constants"
 
@@ -45,10 +50,23 @@ func NewProcessor(ctx context.Context, cfg *config.Config) (*Processor, error) {
 		engine:                     e,
 		sourceStorage:              sourceStorage,
 		store:                      s,
+		flights:                    &singleflight.Group{},
 	}
+	processor.cache = newRenderCache(cfg.Options.RenderCacheSize,
+		time.Duration(cfg.Options.RenderCacheTTL)*time.Second)
+	processor.sourceChecks = newSourceChecks(time.Duration(cfg.Options.SourceCheckInterval) * time.Second)
+	processor.storeQueue = newStoreQueue(cfg.Options.StoreWorkers, cfg.Options.StoreQueueSize,
+		cfg.Options.StoreRetries, time.Duration(cfg.Options.StoreTimeout)*time.Second, processor.Store)
 	if cfg.Options.MaxProcessorConcurrent != nil {
 		processor.withSemaphore = true
-		processor.semaphore = make(chan struct{}, *cfg.Options.MaxProcessorConcurrent)
+		processor.semaphoreSize = int64(*cfg.Options.MaxProcessorConcurrent)
+		processor.semaphore = semaphore.NewWeighted(processor.semaphoreSize)
+		processor.semaphoreWaiting = &atomic.Int64{}
+		processor.interactiveWaiting = &atomic.Int64{}
+		if size := cfg.Options.MaxProcessorBackgroundConcurrent; size > 0 {
+			processor.backgroundSize = int64(size)
+			processor.backgroundSemaphore = semaphore.NewWeighted(processor.backgroundSize)
+		}
 		processor.semaphoreOperations = cfg.Options.MaxProcessorConcurrentOperations
 	}
 	if cfg.Options.MaxImageDimensions != nil {
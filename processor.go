@@ -4,25 +4,29 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	imagepkg "image"
 	"io"
 	"log/slog"
 	"net/url"
 	"os"
 	filepathpkg "path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cstockton/go-conv"
 	"github.com/gin-gonic/gin"
-	"github.com/mholt/binding"
 	"github.com/pkg/errors"
 	"github.com/thoas/picfit/storage"
 	"github.com/ulule/gostorages"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/thoas/picfit/config"
+	"github.com/thoas/picfit/constants"
 	"github.com/thoas/picfit/engine"
+	"github.com/thoas/picfit/engine/backend"
 	"github.com/thoas/picfit/failure"
 	"github.com/thoas/picfit/hash"
 	"github.com/thoas/picfit/image"
@@ -43,8 +47,25 @@ type Processor struct {
 
 	withSemaphore       bool
 	semaphoreOperations []engine.Operation
-	semaphore           chan struct{}
+	semaphore           *semaphore.Weighted
+	semaphoreSize       int64
+	semaphoreWaiting    *atomic.Int64
+	interactiveWaiting  *atomic.Int64
+	backgroundSemaphore *semaphore.Weighted
+	backgroundSize      int64
 	maxImageDimensions  *config.AllowedSize
+
+	flights    *singleflight.Group
+	storeQueue *storeQueue
+	cache      *renderCache
+
+	sourceChecks *sourceChecks
+}
+
+// Shutdown stops storing images in the background and waits until the
+// queued images are stored or the context is done.
+func (p *Processor) Shutdown(ctx context.Context) error {
+	return p.storeQueue.close(ctx)
 }
 
 // Upload uploads a file to its storage
@@ -63,6 +84,12 @@ func (p *Processor) Upload(ctx context.Context, payload *payload.Multipart) (*im
 	if err := fh.Close(); err != nil {
 		return nil, errors.WithStack(err)
 	}
+
+	// the uploaded source is retrieved at the next request
+	if err := p.clearSourceFailure(ctx, filepath); err != nil {
+		return nil, err
+	}
+
 	return &image.ImageFile{
 		Filepath: payload.Data.Filename,
 		Storage:  p.sourceStorage,
@@ -96,20 +123,32 @@ func (p *Processor) Store(ctx context.Context, log *slog.Logger, filepath string
 		slog.Duration("duration", endtime.Sub(starttime)),
 	)
 
-	// Write children info only when we actually want to be able to delete things.
-	if p.config.Options.EnableCascadeDelete {
+	// Write children info only when we actually want to be able to delete things,
+	// storing a focal point deletes the images generated from the source.
+	if p.config.Options.EnableCascadeDelete || p.config.Options.EnableFocalPoint {
 		parentKey := hash.Tokey(filepath)
 
 		parentKey = fmt.Sprintf("%s:children", parentKey)
 
-		if err := p.store.AppendSlice(ctx, parentKey, i.Key); err != nil {
+		// retried and forced images are already in the set
+		children, err := p.store.GetSlice(ctx, parentKey)
+		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		log.InfoContext(ctx, "Put key into set in store",
-			slog.String("set", parentKey),
-			slog.String("value", filepath),
-		)
+		if !slices.ContainsFunc(children, func(child any) bool {
+			key, err := conv.String(child)
+			return err == nil && key == i.Key
+		}) {
+			if err := p.store.AppendSlice(ctx, parentKey, i.Key); err != nil {
+				return errors.WithStack(err)
+			}
+
+			log.InfoContext(ctx, "Put key into set in store",
+				slog.String("set", parentKey),
+				slog.String("value", filepath),
+			)
+		}
 	}
 
 	return nil
@@ -137,9 +176,13 @@ func (p *Processor) DeleteChild(ctx context.Context, key string) error {
 		}
 	}
 
-	if err := p.store.Delete(ctx, key); err != nil {
-		return errors.Wrapf(err, "unable to delete key %s", key)
+	for _, k := range []string{key, sourceVersionKey(key), sourceCheckedKey(key)} {
+		if err := p.store.Delete(ctx, k); err != nil {
+			return errors.Wrapf(err, "unable to delete key %s", k)
+		}
 	}
+	p.cache.delete(key)
+	p.sourceChecks.delete(key)
 
 	p.Logger.InfoContext(ctx, "Deleting child",
 		slog.String("key", key))
@@ -164,6 +207,11 @@ func (p *Processor) Delete(ctx context.Context, filepath string) error {
 		return errors.Wrapf(err, "unable to delete %s on source storage", filepath)
 	}
 
+	return p.deleteChildren(ctx, filepath)
+}
+
+// deleteChildren removes every generated image of a file from store and storage
+func (p *Processor) deleteChildren(ctx context.Context, filepath string) error {
 	parentKey := hash.Tokey(filepath)
 
 	childrenKey := fmt.Sprintf("%s:children", parentKey)
@@ -217,6 +265,43 @@ func (p *Processor) Delete(ctx context.Context, filepath string) error {
 	return nil
 }
 
+// FocalPoint returns the focal point stored for a source file, nil when not set
+func (p *Processor) FocalPoint(ctx context.Context, source string) (*backend.FocalPoint, error) {
+	raw, err := p.store.Get(ctx, focalPointKey(source))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to retrieve focal point of %s", source)
+	}
+
+	if raw == nil {
+		return nil, nil
+	}
+
+	value, err := conv.String(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to cast %v to string", raw)
+	}
+
+	return backend.ParseFocalPoint(value)
+}
+
+// SetFocalPoint stores the focal point of a source file and removes the
+// images already generated from it
+func (p *Processor) SetFocalPoint(ctx context.Context, source string, fp *backend.FocalPoint) error {
+	if err := p.store.Set(ctx, focalPointKey(source), fp.String()); err != nil {
+		return errors.Wrapf(err, "unable to save focal point of %s", source)
+	}
+
+	p.Logger.InfoContext(ctx, "Focal point saved on store",
+		slog.String("source", source),
+		slog.String("focal-point", fp.String()))
+
+	return p.deleteChildren(ctx, source)
+}
+
+func focalPointKey(source string) string {
+	return fmt.Sprintf("%s:focal-point", hash.Tokey(source))
+}
+
 // ProcessContext processes a gin.Context generates and retrieves an ImageFile
 func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (*image.ImageFile, error) {
 	var (
@@ -228,6 +313,21 @@ func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (*image.Image
 	)
 
 	modifiedSince := c.Request.Header.Get("If-Modified-Since")
+
+	// hot images are served from memory without reaching the store nor the storage
+	if force == "" && options.Load {
+		if img := p.cache.get(storeKey, p.destinationReadOnlyStorage); img != nil {
+			if modifiedSince != "" {
+				return nil, failure.ErrFileNotModified
+			}
+
+			log.InfoContext(ctx, "Image retrieved from memory cache")
+			p.revalidate(c, storeKey)
+
+			return img, nil
+		}
+	}
+
 	if modifiedSince != "" && force == "" {
 		exists, err := p.store.Exists(ctx, storeKey)
 		if err != nil {
@@ -263,7 +363,7 @@ func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (*image.Image
 			// no such file, just reprocess (maybe file cache was purged)
 			if err != nil {
 				if os.IsNotExist(err) {
-					return p.processImage(c, storeKey, options.Async)
+					return p.processImageOnce(c, storeKey, options)
 				}
 
 				return nil, errors.WithStack(err)
@@ -279,6 +379,13 @@ func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (*image.Image
 				strings.ToLower(filepathpkg.Ext(filepath)),
 			).Observe(endtime.Sub(starttime).Seconds())
 			img.HTTPStream = img.Stream
+			p.revalidate(c, storeKey)
+			if options.Load {
+				if err := p.cache.set(img); err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+
 			return img, nil
 		}
 
@@ -289,7 +396,51 @@ func (p *Processor) ProcessContext(c *gin.Context, opts ...Option) (*image.Image
 		log.InfoContext(ctx, "Force activated, key will be re-processed")
 	}
 
-	return p.processImage(c, storeKey, options.Async)
+	file, err := p.processImageOnce(c, storeKey, options)
+
+	// the image stored before being forced is served until the load decreases
+	var oerr *failure.OverloadedError
+	if force != "" && errors.As(err, &oerr) {
+		if stale, serr := p.staleFile(ctx, storeKey, options.Load); serr == nil && stale != nil {
+			log.InfoContext(ctx, "Too many images being processed, stale image served")
+
+			return stale, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Load {
+		if err := p.cache.set(file); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return file, nil
+}
+
+// staleFile returns the image stored with the key, if any, regardless of
+// it being re-processed.
+func (p *Processor) staleFile(ctx context.Context, key string, load bool) (*image.ImageFile, error) {
+	filepathRaw, err := p.store.Get(ctx, key)
+	if err != nil || filepathRaw == nil {
+		return nil, err
+	}
+
+	filepath, err := conv.String(filepathRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := p.fileFromStorage(ctx, key, filepath, load)
+	if err != nil {
+		return nil, err
+	}
+	file.HTTPStream = file.Stream
+	file.Headers["X-Picfit-Stale"] = "true"
+
+	return file, nil
 }
 
 func (p *Processor) fileFromStorage(ctx context.Context, key string, filepath string, load bool) (*image.ImageFile, error) {
@@ -314,14 +465,23 @@ func (p *Processor) fileFromStorage(ctx context.Context, key string, filepath st
 	return file, nil
 }
 
-func (p *Processor) processImage(c *gin.Context, storeKey string, async bool) (*image.ImageFile, error) {
+func (p *Processor) processImage(c *gin.Context, storeKey string, options Options) (*image.ImageFile, error) {
 	var (
 		filepath string
+		source   string
 		err      error
 		ctx      = c.Request.Context()
 		log      = p.Logger.With(slog.String("key", storeKey))
+		stored   = options.stored
 	)
 
+	// images queued to be stored are reported by the queue
+	defer func() {
+		if stored != nil {
+			stored()
+		}
+	}()
+
 	file := &image.ImageFile{
 		Key:     storeKey,
 		Storage: p.destinationStorage,
@@ -331,32 +491,56 @@ func (p *Processor) processImage(c *gin.Context, storeKey string, async bool) (*
 	qs := c.MustGet("parameters").(map[string]any)
 	starttime := time.Now()
 	u, exists := c.Get("url")
+	if exists {
+		source = u.(*url.URL).String()
+	} else {
+		filepath = qs["path"].(string)
+		source = filepath
+	}
+
+	// failed sources are not retrieved again until their failure expires
+	if err := p.cachedSourceFailure(ctx, source, c.Query("force") != ""); err != nil {
+		return nil, err
+	}
+
 	if exists {
 		file, err = image.FromURL(ctx, u.(*url.URL), p.config.Options.DefaultUserAgent)
 	} else {
 		// URL provided we use http protocol to retrieve it
-		filepath = qs["path"].(string)
 		if !p.FileExists(ctx, filepath) {
-			return nil, errors.Wrapf(failure.ErrFileNotExists, "unable to process image, file does exist: %s", filepath)
+			return nil, p.sourceFailure(ctx, source,
+				errors.Wrapf(failure.ErrFileNotExists, "unable to process image, file does exist: %s", filepath))
 		}
 
 		file, err = image.FromStorage(ctx, p.sourceStorage, filepath)
 	}
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to process image")
+		return nil, p.sourceFailure(ctx, source, errors.Wrap(err, "unable to process image"))
 	}
 	endtime := time.Now()
 
-	if p.maxImageDimensions != nil {
-		data, err := io.ReadAll(file.Stream)
+	qs, err = p.withFocalPoint(ctx, source, qs)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to process image")
+	}
+
+	if hints, ok := c.Get("hints"); ok {
+		qs = withClientHints(qs, hints.(map[string]any))
+	}
+
+	// sources are checked from their headers before being decoded
+	var info *sourceInfo
+	if p.withSemaphore || p.maxImageDimensions != nil || p.config.Options.MaxImagePixels > 0 ||
+		p.config.Options.MaxAnimationPixels > 0 || p.config.Options.MaxInputBytes > 0 ||
+		p.config.Options.SourceFailureTTL > 0 {
+		info, err = p.inspectSource(file)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return nil, p.sourceFailure(ctx, source, err)
 		}
 
-		if err := p.checkImageMaxDimension(bytes.NewReader(data)); err != nil {
+		if err := p.checkImageLimits(info); err != nil {
 			return nil, err
 		}
-		file.Stream = io.NopCloser(bytes.NewReader(data))
 	}
 
 	defaultMetrics.histogram.WithLabelValues(
@@ -374,6 +558,15 @@ func (p *Processor) processImage(c *gin.Context, storeKey string, async bool) (*
 		return nil, errors.Wrap(err, "unable to process image")
 	}
 
+	// borders grow the image past the limits checked on the source
+	if info != nil {
+		if bordered := borderedSource(info, parameters.operations); bordered != nil {
+			if err := p.checkImageLimits(bordered); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	var containsSemaphoreOps bool
 	for i := range parameters.operations {
 		if slices.Contains(p.semaphoreOperations, parameters.operations[i].Operation) {
@@ -382,24 +575,27 @@ func (p *Processor) processImage(c *gin.Context, storeKey string, async bool) (*
 		}
 	}
 	if p.withSemaphore && containsSemaphoreOps {
-		// Wait for a slot in the semaphore
+		// Wait for slots in the semaphore, large images take more slots
 		semaphorewait := time.Now()
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case p.semaphore <- struct{}{}:
-			break
+		weight := p.semaphoreWeight(info)
+		release, err := p.acquireSemaphore(ctx, weight, options.Priority)
+		if err != nil {
+			return nil, err
 		}
-		log.InfoContext(ctx, "semaphore acquired", slog.Float64("semaphone-wait-duration-sec", time.Since(semaphorewait).Seconds()))
+		log.InfoContext(ctx, "semaphore acquired",
+			slog.Float64("semaphone-wait-duration-sec", time.Since(semaphorewait).Seconds()),
+			slog.Int64("semaphore-weight", weight),
+			slog.String("priority", options.Priority.String()))
 
 		defer func() {
-			<-p.semaphore
+			release()
 			log.InfoContext(ctx, "semaphore released")
 
 		}()
 	}
 
 	starttime = time.Now()
+	// transformations stop at the deadline
 	ctxtimeout, cancel := context.WithTimeout(ctx, time.Second*time.Duration(p.config.Options.TransformTimeout))
 	defer cancel()
 
@@ -410,6 +606,15 @@ func (p *Processor) processImage(c *gin.Context, storeKey string, async bool) (*
 	}
 	data := buf.Bytes()
 
+	// report the quality picked to fit in the byte budget
+	if n := len(parameters.operations); n > 0 && parameters.operations[n-1].Options.MaxBytes > 0 {
+		file.Headers["X-Picfit-Quality"] = strconv.Itoa(parameters.operations[n-1].Options.Quality)
+	}
+
+	if err := p.recordSourceVersion(ctx, storeKey, file); err != nil {
+		log.ErrorContext(ctx, "Unable to record source version", slog.Any("error", err))
+	}
+
 	filename := p.ShardFilename(storeKey)
 	file.Filepath = fmt.Sprintf("%s.%s", filename, file.Format())
 	file.Storage = p.destinationStorage
@@ -419,16 +624,13 @@ func (p *Processor) processImage(c *gin.Context, storeKey string, async bool) (*
 	file.HTTPStream = io.NopCloser(bytes.NewReader(data))
 	file.StorageStream = bytes.NewReader(data)
 	file.Storage = p.destinationStorage
-	if async {
-		go func() {
-			storectx, _ := context.WithTimeout(context.Background(), time.Second*60)
-
-			if err := p.Store(storectx, log, filepath, file); err != nil {
-				log.ErrorContext(storectx, "storage failed", slog.Any("error", err))
-			}
-		}()
+	// the image is stored in the request when the queue is full
+	// images are tracked by their source, a path or an url
+	if options.Async && p.storeQueue.push(storeJob{log: log, filepath: source, file: file, data: data, done: stored}) {
+		stored = nil
+		log.InfoContext(ctx, "Image queued to be stored")
 	} else {
-		if err := p.Store(c.Request.Context(), log, filepath, file); err != nil {
+		if err := p.Store(c.Request.Context(), log, source, file); err != nil {
 			log.ErrorContext(c.Request.Context(), "storage failed", slog.Any("error", err))
 		}
 	}
@@ -449,6 +651,116 @@ func (p *Processor) processImage(c *gin.Context, storeKey string, async bool) (*
 	return file, nil
 }
 
+// withFocalPoint adds the focal point stored for the source to the parameters
+// unless a focal point or a face gravity is explicitly requested
+func (p *Processor) withFocalPoint(ctx context.Context, source string, qs map[string]any) (map[string]any, error) {
+	if !p.config.Options.EnableFocalPoint {
+		return qs, nil
+	}
+
+	if _, ok := qs["fp"]; ok || qs["gravity"] == constants.GravityFace {
+		return qs, nil
+	}
+
+	fp, err := p.FocalPoint(ctx, source)
+	if err != nil || fp == nil {
+		return qs, err
+	}
+
+	parameters := make(map[string]any, len(qs)+1)
+	for k, v := range qs {
+		parameters[k] = v
+	}
+	parameters["fp"] = fp.String()
+
+	return parameters, nil
+}
+
+// withClientHints adds the parameters resolved from client hints,
+// explicit parameters take precedence
+func withClientHints(qs map[string]any, hints map[string]any) map[string]any {
+	parameters := make(map[string]any, len(qs)+len(hints)+1)
+	for k, v := range qs {
+		parameters[k] = v
+	}
+
+	for k, v := range hints {
+		if _, ok := parameters[k]; !ok {
+			parameters[k] = v
+			parameters[constants.HintsParamName] = "1"
+		}
+	}
+
+	return parameters
+}
+
+// Compare computes similarity metrics between two images, each of them can be
+// either an url or a path on the source storage.
+// When dst is provided, a diff image is written to it.
+func (p *Processor) Compare(ctx context.Context, first string, second string, dst io.Writer, options *backend.CompareOptions) (*backend.Comparison, error) {
+	a, err := p.fileFromSource(ctx, first)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to compare images")
+	}
+	defer a.Close()
+
+	b, err := p.fileFromSource(ctx, second)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to compare images")
+	}
+	defer b.Close()
+
+	// both sources are decoded at once, they share their slots
+	release, err := p.admitSources(ctx, a, b)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return backend.Compare(ctx, dst, a, b, options)
+}
+
+// Info returns the dimensions and the faces detected in an image
+func (p *Processor) Info(ctx context.Context, source string) (*backend.Info, error) {
+	file, err := p.fileFromSource(ctx, source)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to inspect image")
+	}
+	defer file.Close()
+
+	release, err := p.admitSources(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	info, err := backend.Inspect(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	info.FocalPoint, err = p.FocalPoint(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// fileFromSource retrieves an ImageFile from an url or from the source storage.
+func (p *Processor) fileFromSource(ctx context.Context, source string) (*image.ImageFile, error) {
+	u, err := url.Parse(source)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return image.FromURL(ctx, u, p.config.Options.DefaultUserAgent)
+	}
+
+	if !p.FileExists(ctx, source) {
+		return nil, errors.Wrapf(failure.ErrFileNotExists, "file does not exist: %s", source)
+	}
+
+	return image.FromStorage(ctx, p.sourceStorage, source)
+}
+
 // ShardFilename shards a filename based on config
 func (p *Processor) ShardFilename(filename string) string {
 	cfg := p.config
@@ -474,17 +786,3 @@ func (p *Processor) FileExists(ctx context.Context, name string) bool {
 func (p *Processor) OpenFile(ctx context.Context, name string) (io.ReadCloser, error) {
 	return p.sourceStorage.Open(ctx, name)
 }
-
-func (p *Processor) checkImageMaxDimension(file io.Reader) error {
-	if p.maxImageDimensions == nil {
-		return nil
-	}
-	imageconfig, _, err := imagepkg.DecodeConfig(file)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if imageconfig.Width > p.maxImageDimensions.Width && imageconfig.Height > p.maxImageDimensions.Height {
-		return binding.Errors{binding.NewError([]string{"dimensions"}, failure.ErrFileMaxDimensions.Error(), fmt.Sprintf("max dimensions is %d x %d", p.maxImageDimensions.Width, p.maxImageDimensions.Height))}
-	}
-	return nil
-}
@@ -5,6 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
 	"io"
 	"mime"
 	"mime/multipart"
@@ -14,7 +17,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,7 +30,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/thoas/picfit"
 	"github.com/thoas/picfit/config"
+	"github.com/thoas/picfit/hash"
 	"github.com/thoas/picfit/server"
 	"github.com/thoas/picfit/signature"
 	"github.com/thoas/picfit/tests"
@@ -601,6 +609,27 @@ func TestDummyApplication(t *testing.T) {
 					Height: 50,
 				},
 			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=50&op=thumbnail&resample=nearest", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=25&h=25&dpr=2&op=resize", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=100&h=50&max-w=50&op=resize", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 25,
+				},
+			},
 			{
 				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=50&op=thumbnail&fmt=jpg", u.String()),
 				Dimensions: &tests.Dimension{
@@ -609,6 +638,55 @@ func TestDummyApplication(t *testing.T) {
 				},
 				ContentType: "image/jpeg",
 			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=50&h=80&op=thumbnail&gravity=face", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  50,
+					Height: 80,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=120&h=80&op=crop&gravity=face", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  120,
+					Height: 80,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:crop+w:120+h:80&op=op:effect+filter:blur-faces", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  120,
+					Height: 80,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:50&op=op:redact+pos:10.10.40.40,50.50.90.90", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  100,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&w=100&h=50&op=resize&op=op:redact+pos:0.0.50.50+mode:blur", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  100,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:50&op=op:effect+filter:enhance", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  100,
+					Height: 50,
+				},
+			},
+			{
+				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:50&op=op:effect+filter:enhance+mode:equalize&op=op:effect+filter:enhance+mode:whitebalance", u.String()),
+				Dimensions: &tests.Dimension{
+					Width:  100,
+					Height: 50,
+				},
+			},
 			{
 				URL: fmt.Sprintf("http://example.com/display?url=%s&op=op:resize+w:100+h:50&op=op:rotate+deg:90", u.String()),
 				Dimensions: &tests.Dimension{
@@ -654,3 +732,1878 @@ func TestDummyApplication(t *testing.T) {
 		}
 	}
 }
+
+func TestCompareHandler(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"enable_compare": true
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		avatar := url.QueryEscape(ts.URL + "/avatar.png")
+		schwarzy := url.QueryEscape(ts.URL + "/schwarzy.jpg")
+
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/compare?a=%s&b=%s", avatar, avatar), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		var comparison struct {
+			SSIM     float64 `json:"ssim"`
+			PSNR     float64 `json:"psnr"`
+			Mismatch float64 `json:"mismatch"`
+		}
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &comparison))
+		assert.InDelta(t, 1, comparison.SSIM, 0.0001)
+		assert.Equal(t, float64(100), comparison.PSNR)
+		assert.Equal(t, float64(0), comparison.Mismatch)
+
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/compare?a=%s&b=%s&diff=1", avatar, schwarzy), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, "image/png", res.Header().Get("Content-Type"))
+		assert.NotEmpty(t, res.Header().Get("X-Picfit-SSIM"))
+
+		img, err := imaging.Decode(res.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, 400, img.Bounds().Dx())
+
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/compare?a=%s", avatar), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 400, res.Code)
+	}, tests.WithConfig(content))
+
+	// sources are checked against the limits before being decoded
+	content = `{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"enable_compare": true,
+		"max_image_pixels": 170000
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		avatar := url.QueryEscape(ts.URL + "/avatar.png")
+		schwarzy := url.QueryEscape(ts.URL + "/schwarzy.jpg")
+
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/compare?a=%s&b=%s", avatar, avatar), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/compare?a=%s&b=%s", avatar, schwarzy), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 400, res.Code)
+	}, tests.WithConfig(content))
+}
+
+func TestInfoHandler(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"enable_info": true
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		for _, filename := range []string{"schwarzy.jpg", "schwarzy-gray.jpg"} {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/info?url=%s", url.QueryEscape(ts.URL+"/"+filename)), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, 200, res.Code)
+
+			var info struct {
+				Width  int `json:"width"`
+				Height int `json:"height"`
+				Faces  []struct {
+					X0 int `json:"x0"`
+					Y0 int `json:"y0"`
+					X1 int `json:"x1"`
+					Y1 int `json:"y1"`
+				} `json:"faces"`
+			}
+			assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &info))
+			assert.Equal(t, 500, info.Width)
+			assert.Equal(t, 357, info.Height)
+			if assert.NotEmpty(t, info.Faces) {
+				face := info.Faces[0]
+				assert.True(t, face.X0 < face.X1 && face.X1 <= info.Width)
+				assert.True(t, face.Y0 < face.Y1 && face.Y1 <= info.Height)
+			}
+		}
+
+		request, _ := http.NewRequest("GET", "http://example.com/info", nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 400, res.Code)
+	}, tests.WithConfig(content))
+
+	// sources are checked against the limits before being decoded
+	content = `{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"enable_info": true,
+		"max_input_bytes": 70000
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/info?url=%s", url.QueryEscape(ts.URL+"/avatar.png")), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 400, res.Code)
+	}, tests.WithConfig(content))
+}
+
+func TestRedactApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	u := ts.URL + "/schwarzy.jpg"
+
+	request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&op=redact&pos=0.0.50.50&mode=fill&color=00ff00&fmt=png", u), nil)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	img, err := imaging.Decode(res.Body)
+	assert.Nil(t, err)
+
+	r, g, b, _ := img.At(10, 10).RGBA()
+	assert.Equal(t, []uint32{0, 0xffff, 0}, []uint32{r, g, b})
+	r, g, b, _ = img.At(400, 300).RGBA()
+	assert.NotEqual(t, []uint32{0, 0xffff, 0}, []uint32{r, g, b})
+
+	for _, pos := range []string{"0.0.abc.50", "10.10.10.50", "0.0.50", "0.0.50.150", "0.0.50.50,"} {
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&op=redact&pos=%s", u, pos), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 400, res.Code, pos)
+	}
+
+	request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&op=redact&pos=0.0.50.50&mode=fill&color=qq", u), nil)
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 400, res.Code)
+}
+
+func TestBlurFacesGrayscale(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	u := ts.URL + "/schwarzy-gray.jpg"
+
+	request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&op=effect&filter=blur-faces&fmt=png", u), nil)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	blurred, err := imaging.Decode(res.Body)
+	assert.Nil(t, err)
+
+	original, err := imaging.Open(path.Join("tests", "fixtures", "schwarzy-gray.jpg"))
+	assert.Nil(t, err)
+
+	// the face of schwarzy-gray.jpg lies around (240, 160)
+	var changed int
+	for y := 120; y < 200; y++ {
+		for x := 200; x < 280; x++ {
+			if color.NRGBAModel.Convert(blurred.At(x, y)) != color.NRGBAModel.Convert(original.At(x, y)) {
+				changed++
+			}
+		}
+	}
+	assert.Greater(t, changed, 1000)
+
+	// the background is left untouched
+	assert.Equal(t, color.NRGBAModel.Convert(original.At(10, 10)), color.NRGBAModel.Convert(blurred.At(10, 10)))
+}
+
+func TestFocalPointHandler(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	tmpDstStorage, err := os.MkdirTemp("", "dst")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDstStorage)
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "kvstore": {
+		"type": "cache"
+	  },
+	  "options": {
+		"enable_focal_point": true,
+		"enable_info": true
+	  },
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpDstStorage, tmpDstStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		u := url.QueryEscape(ts.URL + "/schwarzy.jpg")
+
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&op=thumbnail&w=100&h=357&fp=0,0.5", u), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+		expected := res.Body.Bytes()
+
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&op=thumbnail&w=100&h=357&fp=0.5,0.5", u), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+		assert.NotEqual(t, expected, res.Body.Bytes())
+
+		// the image generated before the focal point is stored is removed
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/get?url=%s&op=thumbnail&w=100&h=357", u), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		request, _ = http.NewRequest("POST", fmt.Sprintf("http://example.com/focalpoint?url=%s&fp=0,0.5", u), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&op=thumbnail&w=100&h=357", u), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, expected, res.Body.Bytes())
+
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/info?url=%s", u), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		var info struct {
+			FocalPoint struct {
+				X float64 `json:"x"`
+				Y float64 `json:"y"`
+			} `json:"focal_point"`
+		}
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &info))
+		assert.Equal(t, float64(0), info.FocalPoint.X)
+		assert.Equal(t, 0.5, info.FocalPoint.Y)
+
+		request, _ = http.NewRequest("POST", fmt.Sprintf("http://example.com/focalpoint?url=%s&fp=2,2", u), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 400, res.Code)
+	}, tests.WithConfig(content))
+}
+
+func TestDerivedSizes(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+	    "allowed_sizes": [
+	      {"width": 100, "height": 100},
+	      {"width": 250, "height": 179}
+	    ]
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		avatar := ts.URL + "/avatar.png"
+		schwarzy := ts.URL + "/schwarzy.jpg"
+
+		tests := []struct {
+			url    string
+			status int
+			width  int
+			height int
+		}{
+			{fmt.Sprintf("url=%s&w=50&h=50&dpr=2&op=resize", avatar), 200, 100, 100},
+			{fmt.Sprintf("url=%s&w=100&h=100&dpr=2&op=resize", avatar), 403, 0, 0},
+			{fmt.Sprintf("url=%s&w=100&h=100&dpr=1&op=resize", avatar), 200, 100, 100},
+			{fmt.Sprintf("url=%s&w=123&h=77&dpr=1&op=resize", avatar), 403, 0, 0},
+			{fmt.Sprintf("url=%s&w=123&h=77&max-w=1000&op=resize", avatar), 403, 0, 0},
+			{fmt.Sprintf("url=%s&w=25p&h=25p&op=resize", avatar), 200, 100, 100},
+			{fmt.Sprintf("url=%s&w=50p&h=50p&op=resize", avatar), 403, 0, 0},
+			{fmt.Sprintf("url=%s&w=50p&h=50p&op=resize", schwarzy), 200, 250, 179},
+			{fmt.Sprintf("url=%s&max-w=250&op=resize", schwarzy), 200, 250, 179},
+			{fmt.Sprintf("url=%s&max-w=1000&op=resize", schwarzy), 403, 0, 0},
+		}
+
+		for _, test := range tests {
+			request, _ := http.NewRequest("GET", "http://example.com/display?"+test.url, nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, test.status, res.Code, test.url)
+
+			if test.status != 200 {
+				continue
+			}
+
+			img, err := imaging.Decode(res.Body)
+			assert.Nil(t, err)
+			assert.Equal(t, test.width, img.Bounds().Dx(), test.url)
+			assert.Equal(t, test.height, img.Bounds().Dy(), test.url)
+		}
+	}, tests.WithConfig(content))
+}
+
+func TestClientHintsApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "kvstore": {
+		"type": "cache"
+	  },
+	  "options": {
+		"enable_client_hints": true
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		u := ts.URL + "/avatar.png"
+
+		display := func(location string, headers map[string]string) (*httptest.ResponseRecorder, int) {
+			request, _ := http.NewRequest("GET", location, nil)
+			for k, v := range headers {
+				request.Header.Set(k, v)
+			}
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			if res.Code != 200 {
+				return res, 0
+			}
+
+			img, err := imaging.Decode(res.Body)
+			assert.Nil(t, err)
+			return res, img.Bounds().Dx()
+		}
+
+		res, width := display(fmt.Sprintf("http://example.com/display?url=%s&op=resize", u), map[string]string{"Sec-CH-Width": "120"})
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, 120, width)
+		assert.Contains(t, res.Header().Get("Accept-CH"), "Sec-CH-DPR")
+		assert.Contains(t, res.Header().Get("Vary"), "Sec-CH-Width")
+
+		// hints are part of the key
+		_, width = display(fmt.Sprintf("http://example.com/display?url=%s&op=resize", u), map[string]string{"Sec-CH-Width": "80"})
+		assert.Equal(t, 80, width)
+
+		// explicit sizes are multiplied by the device pixel ratio
+		_, width = display(fmt.Sprintf("http://example.com/display?url=%s&op=resize&w=50", u), map[string]string{"Sec-CH-DPR": "2"})
+		assert.Equal(t, 100, width)
+
+		_, width = display(fmt.Sprintf("http://example.com/display?url=%s&op=resize&w=50&dpr=1", u), map[string]string{"Sec-CH-DPR": "2"})
+		assert.Equal(t, 50, width)
+	}, tests.WithConfig(content))
+}
+
+func TestMaxBytesApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	u := ts.URL + "/schwarzy.jpg"
+
+	for _, maxBytes := range []int{20000, 3000} {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s&op=resize&w=400&maxbytes=%d", u, maxBytes), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+		assert.LessOrEqual(t, res.Body.Len(), maxBytes)
+
+		quality, err := strconv.Atoi(res.Header().Get("X-Picfit-Quality"))
+		assert.Nil(t, err)
+		assert.True(t, quality >= 10 && quality < 95)
+
+		_, err = imaging.Decode(res.Body)
+		assert.Nil(t, err)
+	}
+
+	// formats without a quality ignore the byte budget
+	for _, filename := range []string{"avatar.png", "giphy.gif"} {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/%s&op=resize&w=100&maxbytes=3000", ts.URL, filename), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+		assert.Empty(t, res.Header().Get("X-Picfit-Quality"), filename)
+	}
+}
+
+func TestEnhanceApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	// a dark and low contrast version of the image is stretched back
+	request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=op:redact+pos:0.0.100.100+mode:fill+color:202020&op=op:flat+pos:0.0.50.100+color:404040&op=op:effect+filter:enhance&fmt=png", ts.URL), nil)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	img, err := imaging.Decode(res.Body)
+	assert.Nil(t, err)
+
+	dark, _, _, _ := img.At(400, 100).RGBA()
+	light, _, _, _ := img.At(100, 100).RGBA()
+	assert.Equal(t, uint32(0), dark>>8)
+	assert.Equal(t, uint32(255), light>>8)
+}
+
+func TestColorEffectsApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	// a black and white image makes the expected colors predictable
+	base := fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=op:redact+pos:0.0.50.100+mode:fill+color:000000&op=op:redact+pos:50.0.100.100+mode:fill+color:ffffff", ts.URL)
+
+	expectations := []struct {
+		effect string
+		dark   [3]uint32
+		light  [3]uint32
+	}{
+		{"filter:duotone+color:ff0000,0000ff", [3]uint32{255, 0, 0}, [3]uint32{0, 0, 255}},
+		{"filter:duotone+color:ff0000+strength:50", [3]uint32{128, 0, 0}, [3]uint32{255, 255, 255}},
+		{"filter:overlay+color:ff0000+strength:100", [3]uint32{255, 0, 0}, [3]uint32{255, 0, 0}},
+		{"filter:tint+color:ff0000+strength:100", [3]uint32{0, 0, 0}, [3]uint32{255, 255, 255}},
+	}
+
+	for _, e := range expectations {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("%s&op=op:effect+%s&fmt=png", base, e.effect), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code, e.effect)
+
+		img, err := imaging.Decode(res.Body)
+		assert.Nil(t, err)
+
+		for point, expected := range map[image.Point][3]uint32{{100, 100}: e.dark, {400, 100}: e.light} {
+			r, g, b, _ := img.At(point.X, point.Y).RGBA()
+			assert.Equal(t, expected, [3]uint32{r >> 8, g >> 8, b >> 8}, e.effect)
+		}
+	}
+
+	request, _ := http.NewRequest("GET", fmt.Sprintf("%s&op=op:effect+filter:tint&fmt=png", base), nil)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.NotEqual(t, 200, res.Code)
+
+	for _, effect := range []string{"filter:tint+color:xyz", "filter:duotone+color:ff0000,xyz"} {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("%s&op=op:effect+%s&fmt=png", base, effect), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 400, res.Code, effect)
+	}
+}
+
+func TestBorderApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=border&size=10.20.30.40&color=ff0000&fmt=png", ts.URL), nil)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	img, err := imaging.Decode(res.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Pt(560, 397), img.Bounds().Size())
+
+	r, g, b, _ := img.At(5, 5).RGBA()
+	assert.Equal(t, []uint32{0xffff, 0, 0}, []uint32{r, g, b})
+	r, g, b, _ = img.At(545, 380).RGBA()
+	assert.Equal(t, []uint32{0xffff, 0, 0}, []uint32{r, g, b})
+
+	// the shadow extends the image with transparent corners
+	request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&op=border&size=10&shadow=20", ts.URL), nil)
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	img, err = imaging.Decode(res.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Pt(440, 440), img.Bounds().Size())
+
+	_, _, _, a := img.At(439, 0).RGBA()
+	assert.Equal(t, uint32(0), a)
+	_, _, _, a = img.At(425, 425).RGBA()
+	assert.NotEqual(t, uint32(0), a)
+
+	request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/giphy.gif&op=border&size=5", ts.URL), nil)
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	anim, err := gif.DecodeAll(res.Body)
+	assert.Nil(t, err)
+	assert.True(t, len(anim.Image) > 1)
+	for i := range anim.Image {
+		assert.Equal(t, image.Pt(410, 310), anim.Image[i].Bounds().Size())
+	}
+
+	for _, query := range []string{"op=border", "op=border&size=100000", "op=border&size=0.0.100000.0", "op=border&size=0&shadow=100000"} {
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&%s", ts.URL, query), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.NotEqual(t, 200, res.Code, query)
+	}
+
+	request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=border&size=10&color=nothex", ts.URL), nil)
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 400, res.Code)
+}
+
+func TestLiquidApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	srv, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=liquid&w=300&h=300", ts.URL), nil)
+	res := httptest.NewRecorder()
+	srv.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	img, err := imaging.Decode(res.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Pt(300, 300), img.Bounds().Size())
+
+	request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/giphy.gif&op=liquid&w=200&h=200", ts.URL), nil)
+	res = httptest.NewRecorder()
+	srv.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	anim, err := gif.DecodeAll(res.Body)
+	assert.Nil(t, err)
+	assert.True(t, len(anim.Image) > 1)
+	for i := range anim.Image {
+		assert.Equal(t, image.Pt(200, 200), anim.Image[i].Bounds().Size())
+	}
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "engine": {
+		"max_liquid_pixels": 10000
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=liquid&w=300&h=300", ts.URL), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+	}, tests.WithConfig(content))
+}
+
+func TestCollageApplication(t *testing.T) {
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "tests/fixtures"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, t.TempDir())
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		ctx := context.Background()
+
+		// images stored in the background are written before the directory is removed
+		server, err := server.NewHTTPServer(suite.Config, suite.Processor)
+		assert.Nil(t, err)
+		defer suite.Processor.Shutdown(ctx)
+
+		red := []uint32{0xffff, 0, 0}
+
+		request, _ := http.NewRequest("GET", "http://example.com/display?path=avatar.png&op=noop&op=op:collage+path:schwarzy.jpg+path:avatar.png+path:schwarzy.jpg+w:400+h:400+gutter:10+color:ff0000&fmt=png", nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		img, err := imaging.Decode(res.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, image.Pt(400, 400), img.Bounds().Size())
+
+		// gutters are drawn with the background color, cells are filled
+		for _, p := range []image.Point{{5, 5}, {200, 100}, {100, 200}, {395, 395}} {
+			r, g, b, _ := img.At(p.X, p.Y).RGBA()
+			assert.Equal(t, red, []uint32{r, g, b}, p.String())
+		}
+		for _, p := range []image.Point{{100, 100}, {300, 100}, {100, 300}, {300, 300}} {
+			r, g, b, _ := img.At(p.X, p.Y).RGBA()
+			assert.NotEqual(t, red, []uint32{r, g, b}, p.String())
+		}
+
+		// a single large cell on top of two fitted cells
+		request, _ = http.NewRequest("GET", "http://example.com/display?path=avatar.png&op=noop&op=op:collage+path:schwarzy.jpg+path:schwarzy.jpg+w:400+h:400+layout:1.2+mode:fill.fit+color:ff0000&fmt=png", nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		img, err = imaging.Decode(res.Body)
+		assert.Nil(t, err)
+
+		r, g, b, _ := img.At(100, 100).RGBA()
+		assert.NotEqual(t, red, []uint32{r, g, b})
+		r, g, b, _ = img.At(100, 205).RGBA()
+		assert.Equal(t, red, []uint32{r, g, b})
+		r, g, b, _ = img.At(100, 300).RGBA()
+		assert.NotEqual(t, red, []uint32{r, g, b})
+
+		request, _ = http.NewRequest("GET", "http://example.com/display?path=avatar.png&op=noop&op=op:collage+path:schwarzy.jpg+mode:stretch", nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.NotEqual(t, 200, res.Code)
+	}, tests.WithConfig(content))
+}
+
+func TestBarcodeApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	isWhite := func(img image.Image, x int, y int) bool {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r == 0xffff && g == 0xffff && b == 0xffff
+	}
+	isBlack := func(img image.Image, x int, y int) bool {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r == 0 && g == 0 && b == 0
+	}
+
+	// a QR code of 2 pixels per module with its quiet zone in the bottom right corner
+	request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=barcode&text=%s&fmt=png", ts.URL, url.QueryEscape("https://example.com")), nil)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	img, err := imaging.Decode(res.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Pt(500, 357), img.Bounds().Size())
+
+	assert.True(t, isWhite(img, 499, 356))
+	assert.True(t, isWhite(img, 500-66, 357-66))
+	assert.True(t, isBlack(img, 500-66+8, 357-66+8))
+	assert.False(t, isWhite(img, 500-67, 357-67))
+
+	// the text can contain colons with the multiple operation system
+	request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=noop&op=op:barcode+text:https://example.com+mode:code128+pos:0.0.100.50+color:ffffff&fmt=png", ts.URL), nil)
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	img, err = imaging.Decode(res.Body)
+	assert.Nil(t, err)
+
+	var bars int
+	for x := 1; x < 500; x++ {
+		if isBlack(img, x, 89) != isBlack(img, x-1, 89) {
+			bars++
+		}
+	}
+	assert.True(t, bars > 20)
+
+	// a QR code of 33 modules is drawn with 3 pixels per module centered in 100x107 pixels
+	request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=barcode&text=%s&pos=0.0.20.30&fmt=png", ts.URL, url.QueryEscape("https://example.com")), nil)
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 200, res.Code)
+
+	img, err = imaging.Decode(res.Body)
+	assert.Nil(t, err)
+	assert.True(t, isBlack(img, 12, 16))
+	assert.True(t, isWhite(img, 11, 16))
+	assert.True(t, isWhite(img, 12, 15))
+
+	for _, query := range []string{"op=barcode", fmt.Sprintf("op=barcode&text=%s&pos=0.0.5.5", url.QueryEscape("https://example.com"))} {
+		request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&%s", ts.URL, query), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.NotEqual(t, 200, res.Code, query)
+	}
+
+	request, _ = http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=barcode&text=", ts.URL), nil)
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, request)
+	assert.Equal(t, 400, res.Code)
+}
+
+func TestBarcodeGIFApplication(t *testing.T) {
+	// the second frame of an optimized GIF only covers a part of the image
+	palette := color.Palette{color.White, color.Black, color.RGBA{0xff, 0, 0, 0xff}}
+	first := image.NewPaletted(image.Rect(0, 0, 200, 200), palette)
+	second := image.NewPaletted(image.Rect(150, 150, 170, 170), palette)
+	for i := range second.Pix {
+		second.Pix[i] = 2
+	}
+
+	body := new(bytes.Buffer)
+	assert.Nil(t, gif.EncodeAll(body, &gif.GIF{
+		Image: []*image.Paletted{first, second},
+		Delay: []int{10, 10},
+	}))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(body.Bytes())
+	}))
+	defer ts.Close()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	// the code is drawn in the top left quarter of every frame
+	for _, query := range []string{"pos=0.0.50.50", "stick=top-left"} {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/optimized.gif&op=barcode&text=hello&%s", ts.URL, query), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		if !assert.Equal(t, 200, res.Code, query) {
+			continue
+		}
+
+		g, err := gif.DecodeAll(res.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(g.Image), query)
+
+		for _, frame := range g.Image {
+			assert.Equal(t, image.Rect(0, 0, 200, 200), frame.Bounds(), query)
+
+			var black bool
+			for y := 0; y < 100 && !black; y++ {
+				for x := 0; x < 100 && !black; x++ {
+					r, g, b, _ := frame.At(x, y).RGBA()
+					black = r == 0 && g == 0 && b == 0
+				}
+			}
+			assert.True(t, black, query)
+		}
+	}
+}
+
+func TestFlattenApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	// the drop shadow leaves the top right corner transparent
+	expectations := []struct {
+		query    string
+		expected []uint32
+	}{
+		{"op=border&size=0&shadow=20&fmt=jpg", []uint32{0xff, 0xff, 0xff, 0xff}},
+		{"op=border&size=0&shadow=20&fmt=jpg&bg=ff0000", []uint32{0xfe, 0, 0, 0xff}},
+		{"op=noop&op=op:border+size:0+shadow:20&op=op:flatten+bg:00ff00&fmt=png", []uint32{0, 0xff, 0, 0xff}},
+	}
+
+	for _, e := range expectations {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&%s", ts.URL, e.query), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code, e.query)
+
+		img, err := imaging.Decode(res.Body)
+		assert.Nil(t, err)
+
+		r, g, b, a := img.At(419, 0).RGBA()
+		assert.Equal(t, e.expected, []uint32{r >> 8, g >> 8, b >> 8, a >> 8}, e.query)
+	}
+
+	for _, query := range []string{"op=flatten&bg=zzzzzz", "op=noop&op=op:flatten+bg:zzzzzz"} {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&%s", ts.URL, query), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 400, res.Code, query)
+	}
+}
+
+func TestDecodeOnceApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	server, err := server.New(context.Background(), config.DefaultConfig())
+	assert.Nil(t, err)
+
+	render := func(query string) []byte {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&q=20&%s", ts.URL, query), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code, query)
+
+		return res.Body.Bytes()
+	}
+
+	// flipping twice is lossless when the image is encoded only once
+	once := render("op=resize&w=500&h=357")
+	chained := render("op=flip&op=noop&op=flip&pos=h")
+	assert.Equal(t, once, chained)
+}
+
+func TestTransformTimeoutApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "engine": {
+		"max_liquid_pixels": 4000000
+	  },
+	  "options": {
+		"transform_timeout": 1
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		// carving hundreds of seams of a large image takes several seconds
+		start := time.Now()
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=liquid&w=2000&h=400", ts.URL), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+		assert.True(t, time.Since(start) < 3*time.Second)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		request, _ = http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=resize&w=100", ts.URL), nil)
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, http.StatusGatewayTimeout, res.Code)
+	}, tests.WithConfig(content))
+}
+
+func TestAdmissionApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	cases := []struct {
+		options string
+		image   string
+		code    int
+		query   string
+	}{
+		// a single dimension exceeding the maximum is rejected
+		{`"max_image_dimensions": {"width": 1000, "height": 100}`, "schwarzy.jpg", http.StatusBadRequest, ""},
+		{`"max_image_dimensions": {"width": 1000, "height": 1000}`, "schwarzy.jpg", http.StatusOK, ""},
+		{`"max_image_pixels": 170000`, "schwarzy.jpg", http.StatusBadRequest, ""},
+		{`"max_image_pixels": 170000`, "avatar.png", http.StatusOK, ""},
+		// giphy.gif has 37 frames of 400x300
+		{`"max_animation_pixels": 4000000`, "giphy.gif", http.StatusBadRequest, ""},
+		{`"max_animation_pixels": 4000000`, "schwarzy.jpg", http.StatusOK, ""},
+		{`"max_input_bytes": 70000`, "avatar.png", http.StatusBadRequest, ""},
+		{`"max_input_bytes": 70000`, "schwarzy.jpg", http.StatusOK, ""},
+		// images larger than the semaphore take all of its slots
+		{`"max_processor_concurrent": 1, "max_processor_concurrent_operations": ["resize"]`, "schwarzy.jpg", http.StatusOK, ""},
+		// borders and shadows are checked with the source, avatar.png is 400x400
+		{`"max_image_pixels": 170000`, "avatar.png", http.StatusOK, "op=border&size=5"},
+		{`"max_image_pixels": 170000`, "avatar.png", http.StatusBadRequest, "op=border&size=50"},
+		{`"max_image_pixels": 170000`, "avatar.png", http.StatusBadRequest, "op=border&size=0&shadow=50"},
+		{`"max_image_dimensions": {"width": 410, "height": 1000}`, "avatar.png", http.StatusBadRequest, "op=border&size=0.0.0.20"},
+	}
+
+	for _, tc := range cases {
+		content := fmt.Sprintf(`{
+		  "debug": true,
+		  "port": 3001,
+		  "options": {%s}
+		}`, tc.options)
+
+		tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+			server, err := server.New(context.Background(), suite.Config)
+			assert.Nil(t, err)
+
+			query := tc.query
+			if query == "" {
+				query = "op=resize&w=100"
+			}
+
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/%s&%s", ts.URL, tc.image, query), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, tc.code, res.Code, tc.options, query)
+		}, tests.WithConfig(content))
+	}
+}
+
+func TestCoalescingApplication(t *testing.T) {
+	var fetches atomic.Int32
+
+	// sources are slow to give time to concurrent requests to arrive
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			fetches.Add(1)
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		http.ServeFile(w, r, path.Join("tests", "fixtures", r.URL.Path))
+	}))
+	defer ts.Close()
+
+	tmpDstStorage, err := os.MkdirTemp("", "dst")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDstStorage)
+
+	cfgs := []string{
+		`{
+		  "debug": true,
+		  "port": 3001
+		}`,
+		// instances of a cluster process an image once with a lock in the store
+		fmt.Sprintf(`{
+		  "debug": true,
+		  "port": 3001,
+		  "options": {
+			"lock_timeout": 5
+		  },
+		  "kvstore": {"type": "cache"},
+		  "storage": {
+			"src": {
+			  "type": "fs",
+			  "location": "%s"
+			},
+			"dst": {
+			  "type": "fs",
+			  "location": "%s"
+			}
+		  }
+		}`, tmpDstStorage, tmpDstStorage),
+	}
+
+	for _, content := range cfgs {
+		fetches.Store(0)
+
+		tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+			server, err := server.New(context.Background(), suite.Config)
+			assert.Nil(t, err)
+
+			var (
+				wg    sync.WaitGroup
+				codes = make([]int, 10)
+				sizes = make([]int, 10)
+			)
+			for i := range codes {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+
+					request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/get?url=%s/avatar.png&op=resize&w=100", ts.URL), nil)
+					res := httptest.NewRecorder()
+					server.ServeHTTP(res, request)
+					codes[i] = res.Code
+					sizes[i] = res.Body.Len()
+				}(i)
+			}
+			wg.Wait()
+
+			assert.Equal(t, int32(1), fetches.Load())
+			for i := range codes {
+				assert.Equal(t, 200, codes[i])
+				assert.Equal(t, sizes[0], sizes[i])
+			}
+		}, tests.WithConfig(content))
+	}
+}
+
+func TestStoreChildrenApplication(t *testing.T) {
+	tmpStorage, err := os.MkdirTemp("", "storage")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpStorage)
+
+	img, err := os.ReadFile("tests/fixtures/avatar.png")
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(tmpStorage, "image.png"), img, 0644))
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"enable_cascade_delete": true
+	  },
+	  "kvstore": {"type": "cache"},
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpStorage, tmpStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		ctx := context.Background()
+
+		// the server shares the store of the suite processor
+		server, err := server.NewHTTPServer(suite.Config, suite.Processor)
+		assert.Nil(t, err)
+
+		// forced images are stored again with the same key
+		for _, query := range []string{"", "?force=1"} {
+			request, _ := http.NewRequest("GET", "http://example.com/get/resize/100x/image.png"+query, nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, 200, res.Code, query)
+		}
+
+		children, err := suite.Processor.GetKey(ctx, hash.Tokey("image.png")+":children")
+		assert.Nil(t, err)
+		assert.Len(t, children, 1)
+	}, tests.WithConfig(content))
+}
+
+func TestLockStoreApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	tmpDstStorage, err := os.MkdirTemp("", "dst")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDstStorage)
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"lock_timeout": 5
+	  },
+	  "kvstore": {"type": "cache"},
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpDstStorage, tmpDstStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		ctx := context.Background()
+
+		// the server shares the store of the suite processor
+		server, err := server.NewHTTPServer(suite.Config, suite.Processor)
+		assert.Nil(t, err)
+
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&op=resize&w=100", ts.URL), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		// other instances find either the lock or the stored image
+		key := res.Header().Get("ETag")
+		locked := func() bool {
+			exists, err := suite.Processor.KeyExists(ctx, key+":lock")
+			assert.Nil(t, err)
+			return exists
+		}
+		stored := func() bool {
+			exists, err := suite.Processor.KeyExists(ctx, key)
+			assert.Nil(t, err)
+			return exists
+		}
+
+		assert.True(t, locked() || stored())
+		assert.Eventually(t, func() bool {
+			return !locked()
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.True(t, stored())
+	}, tests.WithConfig(content))
+}
+
+func TestStoreQueueApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	tmpDstStorage, err := os.MkdirTemp("", "dst")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDstStorage)
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"store_workers": 1,
+		"store_queue_size": 10
+	  },
+	  "kvstore": {"type": "cache"},
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpDstStorage, tmpDstStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		ctx := context.Background()
+
+		processor, err := picfit.NewProcessor(ctx, suite.Config)
+		assert.Nil(t, err)
+
+		server, err := server.NewHTTPServer(suite.Config, processor)
+		assert.Nil(t, err)
+
+		// images of display are stored in the background
+		for i := 0; i < 5; i++ {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&op=resize&w=%d", ts.URL, 100+i), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, 200, res.Code)
+		}
+
+		// queued images are stored on shutdown
+		assert.Nil(t, processor.Shutdown(ctx))
+
+		entries, err := os.ReadDir(tmpDstStorage)
+		assert.Nil(t, err)
+		assert.Equal(t, 5, len(entries))
+
+		// images are stored in the request once the queue is closed
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&op=resize&w=200", ts.URL), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		entries, err = os.ReadDir(tmpDstStorage)
+		assert.Nil(t, err)
+		assert.Equal(t, 6, len(entries))
+	}, tests.WithConfig(content))
+}
+
+func TestLoadSheddingApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	tmpDstStorage, err := os.MkdirTemp("", "dst")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDstStorage)
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "engine": {
+		"max_liquid_pixels": 4000000
+	  },
+	  "options": {
+		"transform_timeout": 3,
+		"max_processor_concurrent": 1,
+		"max_processor_concurrent_operations": ["liquid", "resize"],
+		"max_processor_queue": 1,
+		"max_processor_wait": 1
+	  },
+	  "kvstore": {"type": "cache"},
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpDstStorage, tmpDstStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		get := func(location string) *httptest.ResponseRecorder {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/%s", location), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			return res
+		}
+
+		// use "get" instead of "display" here to force synchronized behaviour
+		stored := fmt.Sprintf("url=%s/avatar.png&op=resize&w=100", ts.URL)
+		assert.Equal(t, 200, get("get?"+stored).Code)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+
+		// carving seams holds the only slot until the transform timeout
+		go func() {
+			defer wg.Done()
+			get(fmt.Sprintf("display?url=%s/schwarzy.jpg&op=liquid&w=2000&h=400", ts.URL))
+		}()
+		time.Sleep(300 * time.Millisecond)
+
+		// the waiting request is shed after the maximum wait
+		var waiting *httptest.ResponseRecorder
+		go func() {
+			defer wg.Done()
+			waiting = get(fmt.Sprintf("display?url=%s/avatar.png&op=resize&w=50", ts.URL))
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		// requests exceeding the queue are shed at once
+		res := get(fmt.Sprintf("display?url=%s/avatar.png&op=resize&w=60", ts.URL))
+		assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+		assert.Equal(t, "1", res.Header().Get("Retry-After"))
+
+		// the stored image is served instead of being re-processed
+		res = get("display?" + stored + "&force=1")
+		assert.Equal(t, 200, res.Code)
+		assert.Equal(t, "true", res.Header().Get("X-Picfit-Stale"))
+
+		wg.Wait()
+		assert.Equal(t, http.StatusServiceUnavailable, waiting.Code)
+		assert.Equal(t, "1", waiting.Header().Get("Retry-After"))
+	}, tests.WithConfig(content))
+}
+
+func TestPriorityApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	tmpDstStorage, err := os.MkdirTemp("", "dst")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDstStorage)
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "engine": {
+		"max_liquid_pixels": 4000000
+	  },
+	  "options": {
+		"transform_timeout": 2,
+		"max_processor_concurrent": 1,
+		"max_processor_background_concurrent": 1,
+		"max_processor_concurrent_operations": ["liquid", "resize"]
+	  },
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpDstStorage, tmpDstStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			order []string
+		)
+		get := func(location string) {
+			defer wg.Done()
+
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/%s", location), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+
+			mu.Lock()
+			order = append(order, strings.SplitN(location, "?", 2)[0])
+			mu.Unlock()
+		}
+
+		wg.Add(3)
+
+		// carving seams holds the only slot until the transform timeout
+		go get(fmt.Sprintf("display?url=%s/schwarzy.jpg&op=liquid&w=2000&h=400", ts.URL))
+		time.Sleep(300 * time.Millisecond)
+
+		// the interactive request waiting after the background one gets the slot first
+		go get(fmt.Sprintf("get?url=%s/avatar.png&op=resize&w=70", ts.URL))
+		time.Sleep(100 * time.Millisecond)
+		go get(fmt.Sprintf("display?url=%s/avatar.png&op=resize&w=80", ts.URL))
+
+		wg.Wait()
+		assert.Equal(t, []string{"display", "display", "get"}, order)
+	}, tests.WithConfig(content))
+}
+
+func TestSemaphoreWeightApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "engine": {
+		"max_liquid_pixels": 4000000
+	  },
+	  "options": {
+		"transform_timeout": 3,
+		"max_processor_concurrent": 4,
+		"max_processor_concurrent_operations": ["liquid", "resize"]
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		carved := make(chan struct{})
+
+		// carving seams holds one slot until the transform timeout
+		go func() {
+			defer close(carved)
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=liquid&w=2000&h=400", ts.URL), nil)
+			server.ServeHTTP(httptest.NewRecorder(), request)
+		}()
+		time.Sleep(300 * time.Millisecond)
+
+		// giphy.gif has 5 megapixels of frames but takes a quarter of the slots,
+		// it does not wait for the carving to free all of them
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/giphy.gif&op=resize&w=100", ts.URL), nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		select {
+		case <-carved:
+			t.Error("the animated image waited for the carving to end")
+		default:
+		}
+
+		<-carved
+	}, tests.WithConfig(content))
+}
+
+func TestSemaphoreInspectApplication(t *testing.T) {
+	ts := tests.NewImageServer()
+	defer ts.Close()
+	defer ts.CloseClientConnections()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "engine": {
+		"max_liquid_pixels": 4000000
+	  },
+	  "options": {
+		"enable_compare": true,
+		"enable_info": true,
+		"transform_timeout": 3,
+		"max_processor_wait": 1,
+		"max_processor_concurrent": 1,
+		"max_processor_concurrent_operations": ["liquid"]
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		carved := make(chan struct{})
+
+		// carving seams holds the slot until the transform timeout
+		go func() {
+			defer close(carved)
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/schwarzy.jpg&op=liquid&w=2000&h=400", ts.URL), nil)
+			server.ServeHTTP(httptest.NewRecorder(), request)
+		}()
+		time.Sleep(300 * time.Millisecond)
+
+		avatar := url.QueryEscape(ts.URL + "/avatar.png")
+		locations := []string{
+			fmt.Sprintf("http://example.com/info?url=%s", avatar),
+			fmt.Sprintf("http://example.com/compare?a=%s&b=%s", avatar, avatar),
+		}
+
+		// sources are decoded with slots of the semaphore
+		for _, location := range locations {
+			request, _ := http.NewRequest("GET", location, nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, http.StatusServiceUnavailable, res.Code, location)
+		}
+
+		<-carved
+
+		for _, location := range locations {
+			request, _ := http.NewRequest("GET", location, nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, http.StatusOK, res.Code, location)
+		}
+	}, tests.WithConfig(content))
+}
+
+func TestRenderCacheApplication(t *testing.T) {
+	var fetches atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			fetches.Add(1)
+		}
+
+		http.ServeFile(w, r, path.Join("tests", "fixtures", r.URL.Path))
+	}))
+	defer ts.Close()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"render_cache_size": 10000000,
+		"render_cache_ttl": 1
+	  }
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		display := func() *httptest.ResponseRecorder {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/avatar.png&op=resize&w=100", ts.URL), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, 200, res.Code)
+			return res
+		}
+
+		// images are not stored without kvstore, they are served from memory
+		first := display()
+		second := display()
+		assert.Equal(t, int32(1), fetches.Load())
+		assert.Equal(t, first.Body.Bytes(), second.Body.Bytes())
+		assert.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+
+		time.Sleep(1100 * time.Millisecond)
+		display()
+		assert.Equal(t, int32(2), fetches.Load())
+	}, tests.WithConfig(content))
+}
+
+func TestRevalidateApplication(t *testing.T) {
+	tmpSrcStorage, err := os.MkdirTemp("", "src")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpSrcStorage)
+
+	tmpDstStorage, err := os.MkdirTemp("", "dst")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDstStorage)
+
+	source := filepath.Join(tmpSrcStorage, "image.jpg")
+	img, err := os.ReadFile("tests/fixtures/avatar.png")
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(source, img, 0644))
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"source_check_interval": 1
+	  },
+	  "kvstore": {"type": "cache"},
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpSrcStorage, tmpDstStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		display := func() image.Point {
+			request, _ := http.NewRequest("GET", "http://example.com/display/resize/100x/image.jpg", nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, 200, res.Code)
+
+			img, err := imaging.Decode(res.Body)
+			assert.Nil(t, err)
+			return img.Bounds().Size()
+		}
+
+		// use "get" instead of "display" here to force synchronized behaviour
+		request, _ := http.NewRequest("GET", "http://example.com/get/resize/100x/image.jpg", nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		// the stale image is served while the changed source is rendered again
+		img, err := os.ReadFile("tests/fixtures/schwarzy.jpg")
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(source, img, 0644))
+		modified := time.Now().Add(time.Hour)
+		assert.Nil(t, os.Chtimes(source, modified, modified))
+
+		assert.Equal(t, image.Pt(100, 100), display())
+		assert.Eventually(t, func() bool {
+			return display() == image.Pt(100, 71)
+		}, 5*time.Second, 100*time.Millisecond)
+	}, tests.WithConfig(content))
+}
+
+func TestRevalidateIntervalApplication(t *testing.T) {
+	tmpStorage, err := os.MkdirTemp("", "dst")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpStorage)
+
+	var heads atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		http.ServeFile(w, r, path.Join("tests", "fixtures", r.URL.Path))
+	}))
+	defer ts.Close()
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"source_check_interval": 60
+	  },
+	  "kvstore": {"type": "cache"},
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpStorage, tmpStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		// use "get" instead of "display" here to force synchronized behaviour
+		for _, method := range []string{"get", "display", "display", "display"} {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/%s?url=%s/avatar.png&op=resize&w=100", method, ts.URL), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, 200, res.Code)
+		}
+
+		// the source is retrieved once then checked once per interval
+		assert.Eventually(t, func() bool {
+			return heads.Load() == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, int32(2), heads.Load())
+	}, tests.WithConfig(content))
+}
+
+func TestRevalidateCascadeDeleteApplication(t *testing.T) {
+	tmpStorage, err := os.MkdirTemp("", "storage")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpStorage)
+
+	img, err := os.ReadFile("tests/fixtures/avatar.png")
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(tmpStorage, "image.png"), img, 0644))
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"enable_delete": true,
+		"enable_cascade_delete": true,
+		"source_check_interval": 60
+	  },
+	  "kvstore": {"type": "cache"},
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpStorage, tmpStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		ctx := context.Background()
+
+		// the server shares the store of the suite processor
+		server, err := server.NewHTTPServer(suite.Config, suite.Processor)
+		assert.Nil(t, err)
+
+		var etag string
+		// use "get" instead of "display" here to force synchronized behaviour
+		for _, method := range []string{"get", "display"} {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/%s/resize/100x/image.png", method), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			assert.Equal(t, 200, res.Code)
+			etag = res.Header().Get("ETag")
+		}
+
+		keys := []string{etag + ":source", etag + ":checked"}
+		for _, key := range keys {
+			exists, err := suite.Processor.KeyExists(ctx, key)
+			assert.Nil(t, err)
+			assert.True(t, exists, key)
+		}
+
+		request, _ := http.NewRequest("DELETE", "http://example.com/image.png", nil)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		// the keys checking the source are deleted with the image
+		for _, key := range keys {
+			exists, err := suite.Processor.KeyExists(ctx, key)
+			assert.Nil(t, err)
+			assert.False(t, exists, key)
+		}
+	}, tests.WithConfig(content))
+}
+
+func TestSourceFailureApplication(t *testing.T) {
+	var fetches atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			fetches.Add(1)
+		}
+
+		switch r.URL.Path {
+		case "/broken.png":
+			w.Write([]byte("not an image"))
+		case "/unavailable.png":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.ServeFile(w, r, path.Join("tests", "fixtures", r.URL.Path))
+		}
+	}))
+	defer ts.Close()
+
+	content := `{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"source_failure_ttl": 60
+	  },
+	  "kvstore": {"type": "cache"}
+	}`
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		display := func(location string) int {
+			request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.com/display?url=%s/%s&op=resize&w=100", ts.URL, location), nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			return res.Code
+		}
+
+		cases := []struct {
+			image string
+			code  int
+		}{
+			{"missing.png", http.StatusNotFound},
+			{"broken.png", http.StatusUnprocessableEntity},
+		}
+
+		for _, tc := range cases {
+			fetches.Store(0)
+
+			// the failure is answered again without fetching the source
+			assert.Equal(t, tc.code, display(tc.image), tc.image)
+			assert.Equal(t, tc.code, display(tc.image), tc.image)
+			assert.Equal(t, int32(1), fetches.Load(), tc.image)
+
+			// forced requests fetch the source again
+			assert.Equal(t, tc.code, display(tc.image+"&force=1"), tc.image)
+			assert.Equal(t, int32(2), fetches.Load(), tc.image)
+		}
+
+		// unavailable sources may recover, they are fetched again
+		fetches.Store(0)
+		assert.Equal(t, http.StatusBadGateway, display("unavailable.png"))
+		assert.Equal(t, http.StatusBadGateway, display("unavailable.png"))
+		assert.Equal(t, int32(2), fetches.Load())
+	}, tests.WithConfig(content))
+}
+
+func TestSourceFailureUploadApplication(t *testing.T) {
+	tmpStorage, err := os.MkdirTemp("", "storage")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpStorage)
+
+	content := fmt.Sprintf(`{
+	  "debug": true,
+	  "port": 3001,
+	  "options": {
+		"enable_upload": true,
+		"source_failure_ttl": 60
+	  },
+	  "kvstore": {"type": "cache"},
+	  "storage": {
+		"src": {
+		  "type": "fs",
+		  "location": "%s"
+		},
+		"dst": {
+		  "type": "fs",
+		  "location": "%s"
+		}
+	  }
+	}`, tmpStorage, tmpStorage)
+
+	tests.Run(t, func(t *testing.T, suite *tests.Suite) {
+		server, err := server.New(context.Background(), suite.Config)
+		assert.Nil(t, err)
+
+		display := func() int {
+			request, _ := http.NewRequest("GET", "http://example.com/display/resize/100x/avatar.png", nil)
+			res := httptest.NewRecorder()
+			server.ServeHTTP(res, request)
+			return res.Code
+		}
+
+		assert.Equal(t, http.StatusNotFound, display())
+
+		img, err := os.ReadFile("tests/fixtures/avatar.png")
+		assert.Nil(t, err)
+
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		writer, err := w.CreateFormFile("data", "avatar.png")
+		assert.Nil(t, err)
+		_, err = writer.Write(img)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Close())
+
+		request, _ := http.NewRequest("POST", "http://example.com/upload", body)
+		request.Header.Add("Content-Type", w.FormDataContentType())
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, request)
+		assert.Equal(t, 200, res.Code)
+
+		// the uploaded source clears its failure
+		assert.Equal(t, http.StatusOK, display())
+	}, tests.WithConfig(content))
+}
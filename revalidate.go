@@ -0,0 +1,217 @@
+package picfit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cstockton/go-conv"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/http"
+	"github.com/thoas/picfit/image"
+	storagepkg "github.com/thoas/picfit/storage"
+	"github.com/thoas/picfit/store"
+)
+
+func sourceVersionKey(storeKey string) string {
+	return fmt.Sprintf("%s:source", storeKey)
+}
+
+func sourceCheckedKey(storeKey string) string {
+	return fmt.Sprintf("%s:checked", storeKey)
+}
+
+// minSourceChecksPrune is the number of tracked keys from which elapsed
+// checks are pruned.
+const minSourceChecksPrune = 1024
+
+// sourceChecks tracks in process the next check of the source of each
+// stored image, the store is only reached once the interval has elapsed.
+type sourceChecks struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+	pruneAt  int
+}
+
+func newSourceChecks(interval time.Duration) *sourceChecks {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &sourceChecks{
+		interval: interval,
+		next:     make(map[string]time.Time),
+		pruneAt:  minSourceChecksPrune,
+	}
+}
+
+// due reports whether the interval has elapsed since the last check of
+// the key and, if so, records a check now.
+func (s *sourceChecks) due(key string, now time.Time) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if next, ok := s.next[key]; ok && now.Before(next) {
+		return false
+	}
+
+	// elapsed checks are pruned as the map grows, it stays bounded by the
+	// number of keys requested during an interval
+	if len(s.next) >= s.pruneAt {
+		for k, next := range s.next {
+			if !now.Before(next) {
+				delete(s.next, k)
+			}
+		}
+		s.pruneAt = max(2*len(s.next), minSourceChecksPrune)
+	}
+
+	s.next[key] = now.Add(s.interval)
+
+	return true
+}
+
+func (s *sourceChecks) delete(key string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.next, key)
+}
+
+// sourceVersion returns the version of a source from its ETag, or its
+// modification time when it has none.
+func sourceVersion(headers map[string]string) string {
+	if etag := headers["Etag"]; etag != "" {
+		return etag
+	}
+
+	return headers["Last-Modified"]
+}
+
+// recordSourceVersion records the version of the source an image is
+// rendered from to detect when the source changes.
+func (p *Processor) recordSourceVersion(ctx context.Context, storeKey string, source *image.ImageFile) error {
+	if p.config.Options.SourceCheckInterval <= 0 {
+		return nil
+	}
+
+	version := sourceVersion(source.Headers)
+	if version == "" {
+		return nil
+	}
+
+	return errors.WithStack(p.store.Set(ctx, sourceVersionKey(storeKey), version))
+}
+
+// revalidate checks once per interval whether the source of a stored image
+// has changed, the image is then rendered again in the background while the
+// stale image is still served.
+func (p *Processor) revalidate(c *gin.Context, storeKey string) {
+	interval := time.Duration(p.config.Options.SourceCheckInterval) * time.Second
+	if !p.sourceChecks.due(storeKey, time.Now()) {
+		return
+	}
+
+	var (
+		ctx = c.Request.Context()
+		log = p.Logger.With(slog.String("key", storeKey))
+	)
+
+	recordedRaw, err := p.store.Get(ctx, sourceVersionKey(storeKey))
+	if err != nil || recordedRaw == nil {
+		return
+	}
+	recorded, err := conv.String(recordedRaw)
+	if err != nil {
+		return
+	}
+
+	// the lock is never released, it expires at the next check and
+	// coordinates the checks between instances
+	_, acquired, err := store.Lock(ctx, p.store, sourceCheckedKey(storeKey), interval)
+	if err != nil {
+		log.ErrorContext(ctx, "Unable to lock source check", slog.Any("error", err))
+		return
+	}
+	if !acquired {
+		return
+	}
+
+	// the request is done before the image is rendered again
+	checkctx, cancel := p.detachContext(ctx)
+	cc := c.Copy()
+	cc.Request = cc.Request.WithContext(checkctx)
+
+	go func() {
+		defer cancel()
+
+		if err := p.revalidateSource(cc, storeKey, recorded); err != nil {
+			log.ErrorContext(ctx, "Source check failed", slog.Any("error", err))
+		}
+	}()
+}
+
+func (p *Processor) revalidateSource(c *gin.Context, storeKey string, recorded string) error {
+	var (
+		ctx     = c.Request.Context()
+		log     = p.Logger.With(slog.String("key", storeKey))
+		headers map[string]string
+	)
+
+	// the url is not parsed when the image is found in the store
+	if value := c.Query("url"); value != "" {
+		u, err := url.Parse(value)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		s := storagepkg.NewHTTPStorage(nil, http.NewClient(http.WithUserAgent(p.config.Options.DefaultUserAgent)))
+		if headers, err = s.HeadersFromURL(u); err != nil {
+			return errors.WithStack(err)
+		}
+
+		c.Set("url", u)
+	} else {
+		filepath, ok := c.MustGet("parameters").(map[string]any)["path"].(string)
+		if !ok {
+			return nil
+		}
+
+		stat, err := p.sourceStorage.Stat(ctx, filepath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		headers = map[string]string{
+			"Last-Modified": stat.ModifiedTime.Format(constants.ModifiedTimeFormat),
+		}
+	}
+
+	if version := sourceVersion(headers); version == "" || version == recorded {
+		return nil
+	}
+
+	log.InfoContext(ctx, "Source changed, image will be rendered again in the background")
+
+	if _, err := p.processImageOnce(c, storeKey, Options{Priority: PriorityBackground}); err != nil {
+		return err
+	}
+	p.cache.delete(storeKey)
+
+	return nil
+}
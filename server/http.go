@@ -145,6 +145,7 @@ func (s *HTTPServer) Init() error {
 	for _, e := range endpoints {
 		views := []gin.HandlerFunc{
 			middleware.ParametersParser(),
+			middleware.ClientHints(s.config.Options.EnableClientHints),
 			middleware.KeyParser(),
 			middleware.Security(s.config.SecretKey),
 			middleware.URLParser(s.config.Options.MimetypeDetector, s.processor),
@@ -167,6 +168,24 @@ func (s *HTTPServer) Init() error {
 			failure.Handle(handlers.upload))
 	}
 
+	if s.config.Options.EnableCompare {
+		router.GET("/compare",
+			restrictIPAddresses,
+			failure.Handle(handlers.compare))
+	}
+
+	if s.config.Options.EnableInfo {
+		router.GET("/info",
+			restrictIPAddresses,
+			failure.Handle(handlers.info))
+	}
+
+	if s.config.Options.EnableFocalPoint {
+		router.POST("/focalpoint",
+			restrictIPAddresses,
+			failure.Handle(handlers.focalPoint))
+	}
+
 	if s.config.Options.EnableDelete {
 		router.DELETE("/*parameters",
 			restrictIPAddresses,
@@ -257,6 +276,15 @@ func (s *HTTPServer) Run(ctx context.Context) error {
 			return err
 		}
 
+		// images queued by the last requests are stored before exiting
+		s.processor.Logger.Debug("Storing queued images")
+		storectx, storecancel := context.WithTimeout(context.Background(),
+			time.Duration(s.config.Options.StoreDrainTimeout)*time.Second)
+		defer storecancel()
+		if err := s.processor.Shutdown(storectx); err != nil {
+			return err
+		}
+
 		s.processor.Logger.Debug("HTTP server exiting")
 
 		return nil
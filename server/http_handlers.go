@@ -1,9 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,6 +16,7 @@ import (
 
 	"github.com/thoas/picfit"
 	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/engine/backend"
 	"github.com/thoas/picfit/failure"
 	"github.com/thoas/picfit/payload"
 )
@@ -134,9 +137,11 @@ func (h handlers) delete(c *gin.Context) error {
 
 // get generates an image synchronously and return its information from storages
 func (h handlers) get(c *gin.Context) error {
+	// images are pre-generated with get, users wait for display and redirect
 	file, err := h.processor.ProcessContext(c,
 		picfit.WithAsync(false),
-		picfit.WithLoad(false))
+		picfit.WithLoad(false),
+		picfit.WithPriority(picfit.PriorityBackground))
 	if err != nil {
 		return err
 	}
@@ -169,6 +174,104 @@ func (h handlers) redirect(c *gin.Context) error {
 	return nil
 }
 
+// compare computes similarity metrics between two images and optionally
+// displays a diff image highlighting the changed pixels
+func (h handlers) compare(c *gin.Context) error {
+	var (
+		first  = c.Query("a")
+		second = c.Query("b")
+		ctx    = c.Request.Context()
+	)
+
+	if first == "" || second == "" {
+		return binding.Errors{binding.NewError([]string{"a", "b"}, binding.RequiredError, "two images are required to compare")}
+	}
+
+	qs := make(map[string]any)
+	for k, v := range c.Request.URL.Query() {
+		qs[k] = v[0]
+	}
+
+	options, err := h.processor.NewCompareOptions(qs)
+	if err != nil {
+		return binding.Errors{binding.NewError([]string{"options"}, binding.TypeError, err.Error())}
+	}
+
+	diff, _ := strconv.ParseBool(c.Query("diff"))
+	if !diff {
+		comparison, err := h.processor.Compare(ctx, first, second, nil, options)
+		if err != nil {
+			return err
+		}
+
+		c.JSON(http.StatusOK, comparison)
+
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	comparison, err := h.processor.Compare(ctx, first, second, buf, options)
+	if err != nil {
+		return err
+	}
+
+	c.Header("X-Picfit-SSIM", strconv.FormatFloat(comparison.SSIM, 'f', -1, 64))
+	c.Header("X-Picfit-PSNR", strconv.FormatFloat(comparison.PSNR, 'f', -1, 64))
+	c.Header("X-Picfit-Mismatch", strconv.FormatFloat(comparison.Mismatch, 'f', -1, 64))
+	c.Data(http.StatusOK, http.DetectContentType(buf.Bytes()), buf.Bytes())
+
+	return nil
+}
+
+// info returns the dimensions and the faces detected in an image
+func (h handlers) info(c *gin.Context) error {
+	source := c.Query("url")
+	if source == "" {
+		source = c.Query("path")
+	}
+
+	if source == "" {
+		return binding.Errors{binding.NewError([]string{"url", "path"}, binding.RequiredError, "an image is required to inspect")}
+	}
+
+	info, err := h.processor.Info(c.Request.Context(), source)
+	if err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, info)
+
+	return nil
+}
+
+// focalPoint stores the focal point of a source image
+func (h handlers) focalPoint(c *gin.Context) error {
+	source := c.Request.FormValue("url")
+	if source == "" {
+		source = c.Request.FormValue("path")
+	}
+
+	if source == "" {
+		return binding.Errors{binding.NewError([]string{"url", "path"}, binding.RequiredError, "an image is required to set its focal point")}
+	}
+
+	fp, err := backend.ParseFocalPoint(c.Request.FormValue("fp"))
+	if err != nil {
+		return binding.Errors{binding.NewError([]string{"fp"}, binding.TypeError, err.Error())}
+	}
+
+	if err := h.processor.SetFocalPoint(c.Request.Context(), source, fp); err != nil {
+		return err
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"source":      source,
+		"focal_point": fp,
+	})
+
+	return nil
+}
+
 func pprofHandler(h http.HandlerFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		h.ServeHTTP(c.Writer, c.Request)
@@ -0,0 +1,218 @@
+package picfit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/constants"
+	"github.com/thoas/picfit/engine/backend"
+	"github.com/thoas/picfit/failure"
+	"github.com/thoas/picfit/image"
+)
+
+const (
+	minDPR = 1
+	maxDPR = 4
+
+	// relativeSuffix marks a size relative to the source image, w=50p is
+	// half of the source width.
+	relativeSuffix = "p"
+)
+
+// sourceSize returns the dimensions of the source image.
+type sourceSize func() (int, int, error)
+
+// newSourceSize returns a sourceSize reading the dimensions of the file
+// the first time they are needed, the stream of the file is buffered so
+// it can still be processed afterwards.
+func newSourceSize(file *image.ImageFile) sourceSize {
+	var (
+		once          sync.Once
+		width, height int
+		err           error
+	)
+
+	return func() (int, int, error) {
+		once.Do(func() {
+			var data []byte
+			data, err = io.ReadAll(file.Stream)
+			if err != nil {
+				err = errors.WithStack(err)
+				return
+			}
+			file.Stream = io.NopCloser(bytes.NewReader(data))
+
+			cfg, cerr := backend.DecodeConfig(bytes.NewReader(data))
+			if cerr != nil {
+				err = cerr
+				return
+			}
+			width, height = cfg.Width, cfg.Height
+		})
+
+		return width, height, err
+	}
+}
+
+// resolveSize computes the output dimensions from the w, h, dpr, max-w and
+// max-h parameters, derived is true when they are not the plain w and h
+// restricted by the RestrictSizes middleware: any dpr, maximum, relative size
+// or client hint.
+// Both dimensions are resolved when a maximum is given.
+func resolveSize(qs map[string]any, source sourceSize) (width int, height int, derived bool, err error) {
+	dpr := 1.0
+	if value, ok := qs["dpr"].(string); ok {
+		dpr, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, 0, false, err
+		}
+
+		if dpr < minDPR || dpr > maxDPR {
+			return 0, 0, false, fmt.Errorf("parameter \"dpr\" should be between %d and %d", minDPR, maxDPR)
+		}
+
+		derived = true
+	}
+
+	if _, ok := qs[constants.HintsParamName]; ok {
+		derived = true
+	}
+
+	width, relativeWidth, err := parseSize(qs, "w", dpr, source, 0)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	height, relativeHeight, err := parseSize(qs, "h", dpr, source, 1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	derived = derived || relativeWidth || relativeHeight
+
+	maxWidth, err := parseMaxSize(qs, "max-w", dpr)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	maxHeight, err := parseMaxSize(qs, "max-h", dpr)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if maxWidth == 0 && maxHeight == 0 {
+		return width, height, derived, nil
+	}
+
+	srcWidth, srcHeight, err := source.size()
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	// effective dimensions of the output, a missing dimension keeps the ratio
+	effWidth, effHeight := float64(width), float64(height)
+	switch {
+	case width == 0 && height == 0:
+		effWidth, effHeight = float64(srcWidth), float64(srcHeight)
+	case width == 0:
+		effWidth = effHeight * float64(srcWidth) / float64(srcHeight)
+	case height == 0:
+		effHeight = effWidth * float64(srcHeight) / float64(srcWidth)
+	}
+
+	// constraints never upscale
+	factor := 1.0
+	if maxWidth > 0 {
+		factor = min(factor, float64(maxWidth)/effWidth)
+	}
+	if maxHeight > 0 {
+		factor = min(factor, float64(maxHeight)/effHeight)
+	}
+
+	return max(1, int(math.Round(effWidth*factor))), max(1, int(math.Round(effHeight*factor))), true, nil
+}
+
+// parseSize parses an absolute size multiplied by the dpr or a size relative
+// to the source dimension at the given index (0 for width, 1 for height).
+func parseSize(qs map[string]any, name string, dpr float64, source sourceSize, index int) (int, bool, error) {
+	value, ok := qs[name].(string)
+	if !ok {
+		return 0, false, nil
+	}
+
+	if percent, ok := strings.CutSuffix(value, relativeSuffix); ok {
+		ratio, err := strconv.ParseFloat(percent, 64)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if ratio <= 0 || ratio > 100 {
+			return 0, false, fmt.Errorf("parameter %q should be between 0 and 100%s", name, relativeSuffix)
+		}
+
+		srcWidth, srcHeight, err := source.size()
+		if err != nil {
+			return 0, false, err
+		}
+
+		dimension := []int{srcWidth, srcHeight}[index]
+
+		return max(1, int(math.Round(float64(dimension)*ratio/100))), true, nil
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return int(math.Round(float64(size) * dpr)), false, nil
+}
+
+func parseMaxSize(qs map[string]any, name string, dpr float64) (int, error) {
+	value, ok := qs[name].(string)
+	if !ok {
+		return 0, nil
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+
+	if size <= 0 {
+		return 0, fmt.Errorf("parameter %q should be positive", name)
+	}
+
+	return int(math.Round(float64(size) * dpr)), nil
+}
+
+func (s sourceSize) size() (int, int, error) {
+	if s == nil {
+		return 0, 0, fmt.Errorf("relative sizes require a source image")
+	}
+
+	return s()
+}
+
+// checkAllowedSize verifies that resolved dimensions are part of the allowed sizes.
+func (p Processor) checkAllowedSize(width int, height int) error {
+	sizes := p.config.Options.AllowedSizes
+	if len(sizes) == 0 {
+		return nil
+	}
+
+	for _, size := range sizes {
+		if size.Width == width && size.Height == height {
+			return nil
+		}
+	}
+
+	return errors.Wrapf(failure.ErrSizeNotAllowed, "size %dx%d is not allowed", width, height)
+}
@@ -0,0 +1,93 @@
+package picfit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/cstockton/go-conv"
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/failure"
+	"github.com/thoas/picfit/hash"
+)
+
+func sourceFailureKey(source string) string {
+	return fmt.Sprintf("%s:failure", hash.Tokey(source))
+}
+
+// sourceFailure records the failure of a source for the next requests of
+// the source to be answered at once, other errors are returned unchanged.
+// Only missing and undecodable sources are recorded, sources answering with
+// an error status may be transiently unavailable.
+func (p *Processor) sourceFailure(ctx context.Context, source string, err error) error {
+	serr := &failure.SourceError{}
+	switch {
+	case errors.As(err, &serr):
+	case errors.Cause(err) == failure.ErrFileNotExists:
+		serr = &failure.SourceError{Type: failure.SourceNotFound, StatusCode: http.StatusNotFound, Err: err}
+	default:
+		return err
+	}
+
+	ttl := time.Duration(p.config.Options.SourceFailureTTL) * time.Second
+	if ttl <= 0 || serr.Type == failure.SourceUnavailable {
+		return serr
+	}
+
+	value, err := json.Marshal(serr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := p.store.SetWithExpiration(ctx, sourceFailureKey(source), string(value), ttl); err != nil {
+		p.Logger.ErrorContext(ctx, "Unable to record source failure",
+			slog.String("source", source), slog.Any("error", err))
+	}
+
+	return serr
+}
+
+// clearSourceFailure deletes the recorded failure of a source.
+func (p *Processor) clearSourceFailure(ctx context.Context, source string) error {
+	if p.config.Options.SourceFailureTTL <= 0 {
+		return nil
+	}
+
+	return errors.WithStack(p.store.Delete(ctx, sourceFailureKey(source)))
+}
+
+// cachedSourceFailure returns the recorded failure of a source, forced
+// requests clear it to retrieve the source again.
+func (p *Processor) cachedSourceFailure(ctx context.Context, source string, force bool) error {
+	if p.config.Options.SourceFailureTTL <= 0 {
+		return nil
+	}
+
+	if force {
+		return p.clearSourceFailure(ctx, source)
+	}
+
+	raw, err := p.store.Get(ctx, sourceFailureKey(source))
+	if err != nil || raw == nil {
+		return errors.WithStack(err)
+	}
+
+	value, err := conv.String(raw)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	serr := &failure.SourceError{}
+	if err := json.Unmarshal([]byte(value), serr); err != nil {
+		return errors.WithStack(err)
+	}
+
+	p.Logger.InfoContext(ctx, "Source failure found in store",
+		slog.String("source", source), slog.String("type", serr.Type))
+
+	return serr
+}
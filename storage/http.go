@@ -64,7 +64,11 @@ func (s *HTTPStorage) OpenFromURL(ctx context.Context, u *url.URL) (io.ReadClose
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%s [status: %d]", u.String(), resp.StatusCode)
+		return nil, &failure.SourceError{
+			Type:       failure.SourceUnavailable,
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("%s [status: %d]", u.String(), resp.StatusCode),
+		}
 	}
 	return resp.Body, nil
 }
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/cstockton/go-conv"
+)
+
+// Lock acquires the lock stored at key for the given expiration and returns
+// the function releasing it, acquired is false when the lock is held by
+// someone else.
+//
+// Stores have no atomic set if not exists: the lock is read back after being
+// set to narrow the race between instances, stores not keeping values such as
+// the dummy one always acquire the lock.
+func Lock(ctx context.Context, s Store, key string, expiration time.Duration) (release func(), acquired bool, err error) {
+	exists, err := s.Exists(ctx, key)
+	if err != nil || exists {
+		return nil, false, err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(b)
+
+	if err := s.SetWithExpiration(ctx, key, token, expiration); err != nil {
+		return nil, false, err
+	}
+
+	value, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if value != nil {
+		if v, err := conv.String(value); err != nil || v != token {
+			return nil, false, err
+		}
+	}
+
+	release = func() {
+		// the lock may have expired and been acquired by someone else
+		ctx := context.WithoutCancel(ctx)
+		if value, err := s.Get(ctx, key); err == nil && value != nil {
+			if v, err := conv.String(value); err == nil && v == token {
+				_ = s.Delete(ctx, key)
+			}
+		}
+	}
+
+	return release, true, nil
+}
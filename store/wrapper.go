@@ -3,6 +3,7 @@ package store
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/ulule/gokvstores"
 )
@@ -44,3 +45,7 @@ func (k *kvstoreWrapper) GetSlice(ctx context.Context, key string) ([]any, error
 func (k *kvstoreWrapper) Delete(ctx context.Context, key string) error {
 	return k.KVStore.Delete(ctx, k.prefixed(key))
 }
+
+func (k *kvstoreWrapper) SetWithExpiration(ctx context.Context, key string, value any, expiration time.Duration) error {
+	return k.KVStore.SetWithExpiration(ctx, k.prefixed(key), value, expiration)
+}
@@ -0,0 +1,138 @@
+package picfit
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/thoas/picfit/image"
+)
+
+// storeBackoff is the wait before the first retry of a failed storage,
+// doubled on each retry.
+const storeBackoff = 100 * time.Millisecond
+
+// storeJob is an image waiting to be stored in the background, the
+// rendered image is kept to be read again on each attempt.
+type storeJob struct {
+	log      *slog.Logger
+	filepath string
+	file     *image.ImageFile
+	data     []byte
+	done     func()
+}
+
+// storeQueue stores images in the background with a bounded number of
+// workers and pending images.
+type storeQueue struct {
+	jobs    chan storeJob
+	store   func(ctx context.Context, log *slog.Logger, filepath string, file *image.ImageFile) error
+	retries int
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newStoreQueue(workers int, size int, retries int, timeout time.Duration,
+	store func(ctx context.Context, log *slog.Logger, filepath string, file *image.ImageFile) error) *storeQueue {
+	q := &storeQueue{
+		jobs:    make(chan storeJob, size),
+		store:   store,
+		retries: max(retries, 0),
+		timeout: timeout,
+	}
+
+	q.wg.Add(workers)
+	for range workers {
+		go func() {
+			defer q.wg.Done()
+
+			for job := range q.jobs {
+				defaultMetrics.storeQueue.Dec()
+				q.process(job)
+			}
+		}()
+	}
+
+	return q
+}
+
+// push adds an image to the queue, it returns false when the queue is full
+// or closed.
+func (q *storeQueue) push(job storeJob) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return false
+	}
+
+	select {
+	case q.jobs <- job:
+		defaultMetrics.storeQueue.Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+// process stores an image, failed storages are retried with a backoff.
+func (q *storeQueue) process(job storeJob) {
+	if job.done != nil {
+		defer job.done()
+	}
+
+	var err error
+	for attempt := 0; attempt <= q.retries; attempt++ {
+		if attempt > 0 {
+			defaultMetrics.storeRetries.Inc()
+			time.Sleep(storeBackoff << (attempt - 1))
+		}
+
+		// each attempt reads the image from the start, the file is shared
+		// with the request
+		file := *job.file
+		file.StorageStream = bytes.NewReader(job.data)
+
+		ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+		err = q.store(ctx, job.log, job.filepath, &file)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		job.log.Error("storage failed", slog.Int("attempt", attempt+1), slog.Any("error", err))
+	}
+
+	defaultMetrics.storeFailures.Inc()
+}
+
+// close stops accepting images and waits until pending images are stored
+// or the context is done.
+func (q *storeQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "%d images not stored", len(q.jobs))
+	}
+}